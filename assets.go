@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	KubecostAssetResponse struct {
+		Code    int64           `json:"code"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	}
+
+	KubecostAsset struct {
+		Type       string            `json:"type"`
+		Properties AssetProperties   `json:"properties"`
+		Labels     map[string]string `json:"labels"`
+		Window     Window            `json:"window"`
+		Start      string            `json:"start"`
+		End        string            `json:"end"`
+		Minutes    float64           `json:"minutes"`
+		ByteHours  float64           `json:"byteHours"`
+		Adjustment float64           `json:"adjustment"`
+		TotalCost  float64           `json:"totalCost"`
+	}
+
+	AssetProperties struct {
+		Category   string `json:"category"`
+		Provider   string `json:"provider"`
+		Account    string `json:"account"`
+		Project    string `json:"project"`
+		Service    string `json:"service"`
+		Cluster    string `json:"cluster"`
+		Name       string `json:"name"`
+		ProviderID string `json:"providerID"`
+	}
+)
+
+// assetUsageTypes maps the exported Kubecost asset types to the UsageType of their rows.
+var assetUsageTypes = map[string]string{
+	"Node":         "node",
+	"Disk":         "disk",
+	"LoadBalancer": "loadBalancer",
+}
+
+// getAssets requests the node, disk and load balancer assets of the day starting at d from the Kubecost
+// Assets API, with the same retry policy as the allocation pages.
+// https://docs.kubecost.com/apis/monitoring-apis/assets-api
+func (a *App) getAssets(endpoint KubecostEndpoint, d time.Time) ([]KubecostAsset, error) {
+	reqURL, err := endpoint.url(endpoint.Host, endpoint.APIPath, "assets")
+	if err != nil {
+		return nil, fmt.Errorf("failed to build assets URL: %w", err)
+	}
+
+	q := url.Values{}
+	q.Add("window", formatWindow(d))
+	q.Add("accumulate", "true")
+	reqURL += "?" + q.Encode()
+
+	var assets []KubecostAsset
+	err = a.retryKubecost(reqURL, func() (bool, error) {
+		return a.requestKubecost(endpoint, reqURL, func(r io.Reader) (int64, string, error) {
+			var j KubecostAssetResponse
+			if err := json.NewDecoder(r).Decode(&j); err != nil {
+				return 0, "", err
+			}
+			var decodeErr error
+			assets, decodeErr = decodeAssetSets(j.Data)
+			return j.Code, j.Message, decodeErr
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return assets, nil
+}
+
+// decodeAssetSets decodes the data of an assets response, which depending on the Kubecost version is
+// either a single asset set or a list of asset sets, and returns the exported asset types sorted by key.
+func decodeAssetSets(data json.RawMessage) ([]KubecostAsset, error) {
+	var sets []map[string]KubecostAsset
+
+	data = bytes.TrimSpace(data)
+	switch {
+	case len(data) == 0 || bytes.Equal(data, []byte("null")):
+		return nil, nil
+	case data[0] == '[':
+		if err := json.Unmarshal(data, &sets); err != nil {
+			return nil, err
+		}
+	default:
+		var set map[string]KubecostAsset
+		if err := json.Unmarshal(data, &set); err != nil {
+			return nil, err
+		}
+		sets = append(sets, set)
+	}
+
+	var assets []KubecostAsset
+	for _, set := range sets {
+		keys := make([]string, 0, len(set))
+		for key := range set {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if _, ok := assetUsageTypes[set[key].Type]; ok {
+				assets = append(assets, set[key])
+			}
+		}
+	}
+
+	return assets, nil
+}
+
+// getCSVRowFromAsset maps an asset to a row with the same columns as the allocation rows. The ResourceID
+// is the provider ID of the asset and the usage is given in hours, or in byte hours for disks.
+func (a *App) getCSVRowFromAsset(conversion currencyConversion, month string, asset KubecostAsset) []string {
+	usageType := assetUsageTypes[asset.Type]
+
+	usageAmount, usageUnit := asset.Minutes/60, "hours"
+	if asset.Type == "Disk" {
+		usageAmount, usageUnit = asset.ByteHours, "byteHours"
+	}
+
+	resourceID := asset.Properties.ProviderID
+	if resourceID == "" {
+		resourceID = asset.Properties.Name
+	}
+
+	cluster := asset.Properties.Cluster
+	if cluster == "" {
+		cluster = "Cluster"
+	}
+
+	node := ""
+	if asset.Type == "Node" {
+		node = asset.Properties.Name
+	}
+
+	start, end := asset.Start, asset.End
+	if start == "" {
+		start = asset.Window.Start
+	}
+	if end == "" {
+		end = asset.Window.End
+	}
+
+	labels := a.labelRules.apply(assetLabels(asset))
+	multiplier, multiplierRule := a.multiplier(cluster, "", usageType, labels)
+	cost, currencyCode, original := conversion.values(multiplier * asset.TotalCost)
+
+	return a.formatRow(append([]string{
+		resourceID,
+		cost,
+		currencyCode,
+		"asset",
+		usageType,
+		strconv.FormatFloat(usageAmount, 'f', 5, 64),
+		usageUnit,
+		cluster,
+		"",
+		"",
+		"",
+		node,
+		"",
+		"",
+		asset.Properties.ProviderID,
+		labelsToJSON(labels),
+		strings.ReplaceAll(month, "-", ""),
+		asset.Window.Start,
+		start,
+		end,
+		asset.Properties.Provider,
+		"",
+		multiplierRule,
+	}, original...), labels)
+}
+
+func assetLabels(asset KubecostAsset) map[string]string {
+	mapLabels := make(map[string]string, len(asset.Labels)+4)
+	for k, v := range asset.Labels {
+		mapLabels[k] = v
+	}
+	if asset.Properties.Name != "" {
+		mapLabels["kc-asset-name"] = asset.Properties.Name
+	}
+	if asset.Properties.Category != "" {
+		mapLabels["kc-asset-category"] = asset.Properties.Category
+	}
+	if asset.Properties.Provider != "" {
+		mapLabels["kc-asset-provider"] = asset.Properties.Provider
+	}
+	if asset.Properties.Cluster != "" {
+		mapLabels["kc-cluster"] = asset.Properties.Cluster
+	}
+
+	return mapLabels
+}
+
+// writeAssetRows writes a row for each asset of the day to the file writer and returns the number of rows.
+func (a *App) writeAssetRows(endpoint KubecostEndpoint, d time.Time, conversion currencyConversion, fileWriter *FileWriter) (int, error) {
+	assets, err := a.getAssets(endpoint, d)
+	if err != nil {
+		return 0, err
+	}
+
+	month := d.Format("2006-01")
+	for _, asset := range assets {
+		if err := fileWriter.writeRow(a.getCSVRowFromAsset(conversion, month, asset)); err != nil {
+			return 0, err
+		}
+	}
+
+	log.Printf("Processed %d assets", len(assets))
+	return len(assets), nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+// parseBackfillArgs parses the arguments of the backfill command: --from YYYY-MM-DD --to YYYY-MM-DD.
+func parseBackfillArgs(args []string) (dateRange, error) {
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	from := fs.String("from", "", "first day to backfill (YYYY-MM-DD)")
+	to := fs.String("to", "", "last day to backfill (YYYY-MM-DD)")
+
+	var r dateRange
+	if err := fs.Parse(args); err != nil {
+		return r, err
+	}
+
+	if *from == "" || *to == "" {
+		return r, fmt.Errorf("backfill requires --from and --to")
+	}
+
+	if err := r.Set(*from + "," + *to); err != nil {
+		return r, fmt.Errorf("invalid backfill range: %v", err)
+	}
+
+	return r, nil
+}
+
+// backfill exports and uploads every complete month within r. A month is complete when all of its
+// days are within r and it has already ended. The same export and upload steps of a regular run are
+// used, with the invoice months replaced by the backfilled ones.
+func (a *App) backfill(r dateRange) error {
+	months := backfillMonths(r, time.Now().Local())
+	if len(months) == 0 {
+		return fmt.Errorf("no complete month between %s and %s to backfill", r.from.Format("2006-01-02"), r.to.Format("2006-01-02"))
+	}
+
+	log.Printf("Backfilling months %v", months)
+
+	a.setBackfillPeriod(months)
+	a.cleanupTempFiles()
+	if err := a.updateFileList(); err != nil {
+		return err
+	}
+	if err := a.updateFromKubecost(); err != nil {
+		return err
+	}
+
+	return a.upload()
+}
+
+// setBackfillPeriod replaces the invoice months with the given ones. The mandatory file saving period
+// is extended back to the first backfilled month, so updateFileList does not rotate the files being
+// backfilled nor the ones of the regular invoice months.
+func (a *App) setBackfillPeriod(months []string) {
+	a.invoiceMonths = months
+	a.filesToUpload = make(map[string]map[string]struct{})
+	for _, month := range months {
+		a.filesToUpload[month] = make(map[string]struct{})
+	}
+
+	if first := a.firstInvoiceDay(); first.Before(a.mandatoryFileSavingPeriodStartDate) {
+		a.mandatoryFileSavingPeriodStartDate = first
+	}
+}
+
+// backfillMonths returns the months, formatted as YYYY-MM, whose days are all within r and that ended before now.
+func backfillMonths(r dateRange, now time.Time) []string {
+	var months []string
+	currentMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+
+	for month := time.Date(r.from.Year(), r.from.Month(), 1, 0, 0, 0, 0, time.Local); !month.After(r.to); month = month.AddDate(0, 1, 0) {
+		lastDay := month.AddDate(0, 1, -1)
+		if month.Before(r.from) || lastDay.After(r.to) || !month.Before(currentMonth) {
+			log.Printf("Skipping month %s because it is not complete within the backfill range", month.Format("2006-01"))
+			continue
+		}
+		months = append(months, month.Format("2006-01"))
+	}
+
+	return months
+}
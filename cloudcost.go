@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	KubecostCloudCostResponse struct {
+		Code    int64  `json:"code"`
+		Message string `json:"message"`
+		Data    struct {
+			Sets []CloudCostSet `json:"sets"`
+		} `json:"data"`
+	}
+
+	CloudCostSet struct {
+		CloudCosts map[string]CloudCost `json:"cloudCosts"`
+		Window     Window               `json:"window"`
+	}
+
+	CloudCost struct {
+		Properties       CloudCostProperties `json:"properties"`
+		Window           Window              `json:"window"`
+		ListCost         CloudCostMetric     `json:"listCost"`
+		NetCost          CloudCostMetric     `json:"netCost"`
+		AmortizedNetCost CloudCostMetric     `json:"amortizedNetCost"`
+		InvoicedCost     CloudCostMetric     `json:"invoicedCost"`
+		AmortizedCost    CloudCostMetric     `json:"amortizedCost"`
+	}
+
+	CloudCostProperties struct {
+		ProviderID      string            `json:"providerID"`
+		Provider        string            `json:"provider"`
+		AccountID       string            `json:"accountID"`
+		InvoiceEntityID string            `json:"invoiceEntityID"`
+		Service         string            `json:"service"`
+		Category        string            `json:"category"`
+		Labels          map[string]string `json:"labels"`
+	}
+
+	CloudCostMetric struct {
+		Cost float64 `json:"cost"`
+	}
+)
+
+var cloudCostMetrics = []string{"listCost", "netCost", "amortizedNetCost", "invoicedCost", "amortizedCost"}
+
+// metric returns the given metric, one of cloudCostMetrics.
+func (c CloudCost) metric(name string) CloudCostMetric {
+	switch name {
+	case "listCost":
+		return c.ListCost
+	case "netCost":
+		return c.NetCost
+	case "invoicedCost":
+		return c.InvoicedCost
+	case "amortizedCost":
+		return c.AmortizedCost
+	default:
+		return c.AmortizedNetCost
+	}
+}
+
+// getCloudCosts requests the out-of-cluster cloud costs of the day starting at d from the Kubecost Cloud
+// Cost API, without aggregation so each cloud resource keeps its own properties and labels. Only the costs
+// tagged with one of the CloudCostLabels are kept, they are the costs Kubecost reports as externalCost in the
+// allocations when its out-of-cluster label mapping uses the same labels.
+// https://docs.kubecost.com/apis/monitoring-apis/cloud-cost-api
+func (a *App) getCloudCosts(endpoint KubecostEndpoint, d time.Time) ([]CloudCost, error) {
+	reqURL, err := endpoint.url(endpoint.Host, endpoint.APIPath, "cloudCost")
+	if err != nil {
+		return nil, fmt.Errorf("failed to build cloud cost URL: %w", err)
+	}
+
+	q := url.Values{}
+	q.Add("window", formatWindow(d))
+	q.Add("accumulate", "true")
+	reqURL += "?" + q.Encode()
+
+	var cloudCosts []CloudCost
+	err = a.retryKubecost(reqURL, func() (bool, error) {
+		return a.requestKubecost(endpoint, reqURL, func(r io.Reader) (int64, string, error) {
+			var j KubecostCloudCostResponse
+			if err := json.NewDecoder(r).Decode(&j); err != nil {
+				return 0, "", err
+			}
+
+			cloudCosts = nil
+			for _, set := range j.Data.Sets {
+				keys := make([]string, 0, len(set.CloudCosts))
+				for key := range set.CloudCosts {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+
+				for _, key := range keys {
+					cloudCost := set.CloudCosts[key]
+					if !a.isAllocatedCloudCost(cloudCost) {
+						continue
+					}
+					if cloudCost.Properties.ProviderID == "" {
+						cloudCost.Properties.ProviderID = key
+					}
+					if cloudCost.Window.Start == "" {
+						cloudCost.Window = set.Window
+					}
+					cloudCosts = append(cloudCosts, cloudCost)
+				}
+			}
+			return j.Code, j.Message, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cloudCosts, nil
+}
+
+// isAllocatedCloudCost reports whether the cloud cost has one of the CloudCostLabels.
+func (a *App) isAllocatedCloudCost(cloudCost CloudCost) bool {
+	for _, key := range a.CloudCostLabels {
+		if cloudCost.Properties.Labels[key] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// getCSVRowFromCloudCost maps a cloud cost to a row with the same columns as the allocation rows, the
+// CloudCostNamespaceLabel in the Namespace column, and the provider and service of the cloud resource in the
+// Provider and Service columns.
+func (a *App) getCSVRowFromCloudCost(conversion currencyConversion, month, cluster string, cloudCost CloudCost) []string {
+	properties := cloudCost.Properties
+
+	mapLabels := make(map[string]string, len(properties.Labels)+3)
+	for k, v := range properties.Labels {
+		mapLabels[k] = v
+	}
+	if properties.AccountID != "" {
+		mapLabels["kc-account-id"] = properties.AccountID
+	}
+	if properties.InvoiceEntityID != "" {
+		mapLabels["kc-invoice-entity-id"] = properties.InvoiceEntityID
+	}
+	if properties.Category != "" {
+		mapLabels["kc-category"] = properties.Category
+	}
+	mapLabels = a.labelRules.apply(mapLabels)
+	namespace := properties.Labels[a.CloudCostNamespaceLabel]
+	multiplier, multiplierRule := a.multiplier(cluster, namespace, "cloudCost", mapLabels)
+	cost, currencyCode, original := conversion.values(multiplier * cloudCost.metric(a.CloudCostMetric).Cost)
+
+	return a.formatRow(append([]string{
+		properties.ProviderID,
+		cost,
+		currencyCode,
+		"cloudCost",
+		"cloudCost",
+		strconv.FormatFloat(0, 'f', 5, 64),
+		"",
+		cluster,
+		"",
+		namespace,
+		"",
+		"",
+		"",
+		"",
+		properties.ProviderID,
+		labelsToJSON(mapLabels),
+		strings.ReplaceAll(month, "-", ""),
+		cloudCost.Window.Start,
+		cloudCost.Window.Start,
+		cloudCost.Window.End,
+		properties.Provider,
+		properties.Service,
+		multiplierRule,
+	}, original...), mapLabels)
+}
+
+// writeCloudCostRows writes a row for each cloud cost of the day to the file writer and returns the number of rows.
+// Kubecost instances sharing a cloud account report the same cloud costs, so the costs of an account are only
+// written by the first endpoint reporting it, in the KUBECOST_ENDPOINTS order.
+func (a *App) writeCloudCostRows(endpoint KubecostEndpoint, d time.Time, conversion currencyConversion, fileWriter *FileWriter) (int, error) {
+	cloudCosts, err := a.cachedCloudCosts(endpoint, d)
+	if err != nil {
+		return 0, err
+	}
+
+	exportedAccounts := make(map[string]struct{})
+	for _, other := range a.endpoints {
+		if other.Name == endpoint.Name {
+			break
+		}
+
+		otherCloudCosts, err := a.cachedCloudCosts(other, d)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get cloud costs of %s: %v", other.label(), err)
+		}
+		for _, cloudCost := range otherCloudCosts {
+			exportedAccounts[cloudCost.account()] = struct{}{}
+		}
+	}
+
+	// The cloud costs are not related to a single cluster, the rows are attributed to the endpoint
+	cluster := endpoint.Name
+	if cluster == "" {
+		cluster = "Cluster"
+	}
+
+	month := d.Format("2006-01")
+	rows := 0
+	for _, cloudCost := range cloudCosts {
+		if _, ok := exportedAccounts[cloudCost.account()]; ok {
+			continue
+		}
+		if err := fileWriter.writeRow(a.getCSVRowFromCloudCost(conversion, month, cluster, cloudCost)); err != nil {
+			return 0, err
+		}
+		rows++
+	}
+
+	log.Printf("Processed %d cloud costs, %d exported by another endpoint", rows, len(cloudCosts)-rows)
+	return rows, nil
+}
+
+// account returns the key of the cloud account of a cost. Account IDs are only unique within a provider.
+func (c CloudCost) account() string {
+	return c.Properties.Provider + "/" + c.Properties.AccountID
+}
+
+// cloudCostsRequest is the request of the cloud costs of an endpoint for a day, shared by the endpoints
+// of a cycle so they are requested once.
+type cloudCostsRequest struct {
+	once       sync.Once
+	cloudCosts []CloudCost
+	err        error
+}
+
+// cachedCloudCosts returns the cloud costs of the day starting at d reported by endpoint, requesting them
+// once per cycle.
+func (a *App) cachedCloudCosts(endpoint KubecostEndpoint, d time.Time) ([]CloudCost, error) {
+	key := endpoint.Name + "/" + d.Format("2006-01-02")
+
+	a.cloudCostsMutex.Lock()
+	if a.cloudCostRequests == nil {
+		a.cloudCostRequests = make(map[string]*cloudCostsRequest)
+	}
+	request, ok := a.cloudCostRequests[key]
+	if !ok {
+		request = &cloudCostsRequest{}
+		a.cloudCostRequests[key] = request
+	}
+	a.cloudCostsMutex.Unlock()
+
+	request.once.Do(func() {
+		request.cloudCosts, request.err = a.getCloudCosts(endpoint, d)
+	})
+	return request.cloudCosts, request.err
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// labelColumn is a label promoted to its own column, with the value written when a row does not have it.
+type labelColumn struct {
+	key          string
+	defaultValue string
+}
+
+// csvColumns are the built-in columns, in the order the rows are built. COLUMNS selects and orders
+// a subset of them.
+var csvColumns = []string{
+	"ResourceID",
+	"Cost",
+	"CurrencyCode",
+	"Aggregation",
+	"UsageType",
+	"UsageAmount",
+	"UsageUnit",
+	"Cluster",
+	"Container",
+	"Namespace",
+	"Pod",
+	"Node",
+	"Controller",
+	"ControllerKind",
+	"ProviderID",
+	"Labels",
+	"InvoiceYearMonth",
+	"InvoiceDate",
+	"StartTime",
+	"EndTime",
+	"Provider",
+	"Service",
+	"MultiplierRule",
+	"OriginalCost",
+	"OriginalCurrency",
+	"ExchangeRate",
+}
+
+// defaultColumnCount is the number of columns exported when COLUMNS is not set, Provider and Service
+// being only added when the cloud costs are exported, MultiplierRule when there are multiplier rules, and
+// the original cost, currency and exchange rate when the costs are converted to TARGET_CURRENCY.
+const defaultColumnCount = 20
+
+var csvColumnIndex = func() map[string]int {
+	index := make(map[string]int, len(csvColumns))
+	for i, column := range csvColumns {
+		index[column] = i
+	}
+	return index
+}()
+
+// validateColumns checks the COLUMNS names and parses the LABEL_COLUMNS, given as label keys
+// optionally followed by =default.
+func (a *App) validateColumns() error {
+	names := make(map[string]struct{}, len(a.Columns)+len(a.LabelColumns))
+	for _, column := range a.Columns {
+		if _, ok := csvColumnIndex[column]; !ok {
+			return fmt.Errorf("column: %s is wrong", column)
+		}
+		if _, ok := names[column]; ok {
+			return fmt.Errorf("column: %s is used more than once", column)
+		}
+		names[column] = struct{}{}
+	}
+
+	a.labelColumns = nil
+	for _, column := range a.LabelColumns {
+		key, defaultValue, ok := strings.Cut(column, "=")
+		if !ok {
+			defaultValue = a.LabelColumnDefault
+		}
+		key = strings.TrimSpace(key)
+		if key == "" {
+			return fmt.Errorf("label column: %q has no label key", column)
+		}
+		if _, ok := csvColumnIndex[key]; ok {
+			return fmt.Errorf("label column: %s conflicts with a built-in column", key)
+		}
+		if _, ok := names[key]; ok {
+			return fmt.Errorf("label column: %s is used more than once", key)
+		}
+		names[key] = struct{}{}
+		a.labelColumns = append(a.labelColumns, labelColumn{key: key, defaultValue: defaultValue})
+	}
+
+	return nil
+}
+
+// columns returns the built-in columns to export.
+func (a *App) columns() []string {
+	if len(a.Columns) > 0 {
+		return a.Columns
+	}
+	columns := csvColumns[:defaultColumnCount:defaultColumnCount]
+	// The cloud costs are itemized with the provider and service of each cloud resource
+	if a.ExportCloudCosts {
+		columns = append(columns, "Provider", "Service")
+	}
+	if len(a.multiplierRules) > 0 {
+		columns = append(columns, "MultiplierRule")
+	}
+	if a.TargetCurrency != "" {
+		columns = append(columns, "OriginalCost", "OriginalCurrency", "ExchangeRate")
+	}
+	return columns
+}
+
+func (a *App) getCSVHeaders() []string {
+	headers := slices.Clone(a.columns())
+	for _, column := range a.labelColumns {
+		headers = append(headers, column.key)
+	}
+	return headers
+}
+
+// formatRow projects a row holding every built-in column, in the csvColumns order, onto the exported
+// columns, followed by the label columns taken from labels.
+func (a *App) formatRow(values []string, labels map[string]string) []string {
+	columns := a.columns()
+	row := make([]string, 0, len(columns)+len(a.labelColumns))
+	for _, column := range columns {
+		row = append(row, values[csvColumnIndex[column]])
+	}
+	for _, column := range a.labelColumns {
+		value, ok := labels[column.key]
+		if !ok || value == "" {
+			value = column.defaultValue
+		}
+		row = append(row, value)
+	}
+	return row
+}
+
+func labelsToJSON(labels map[string]string) string {
+	labelsJSON, _ := json.Marshal(labels)
+	return string(labelsJSON)
+}
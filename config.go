@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/caarlos0/env/v11"
+	"gopkg.in/yaml.v3"
+)
+
+// configFile is the YAML or JSON configuration file given with --config or CONFIG_FILE.
+var configFile = os.Getenv("CONFIG_FILE")
+
+const redactedValue = "REDACTED"
+
+// loadConfig builds the configuration from the envDefault values, the configuration file and the
+// environment, in increasing order of precedence. Only the keys present in the file override the
+// defaults, and a field is taken from the file only when its environment variable is not set.
+func loadConfig(configFile string) (Config, error) {
+	var cfg Config
+	if err := env.Parse(&cfg); err != nil {
+		return cfg, err
+	}
+
+	if configFile == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	// JSON is valid YAML, so both formats go through the same decoder
+	var fileConfig Config
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&fileConfig); err != nil && err != io.EOF {
+		return cfg, fmt.Errorf("failed to parse config file %s: %v", configFile, err)
+	}
+
+	var keys map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return cfg, fmt.Errorf("failed to parse config file %s: %v", configFile, err)
+	}
+
+	cfgValue := reflect.ValueOf(&cfg).Elem()
+	fileValue := reflect.ValueOf(fileConfig)
+	for i := 0; i < cfgValue.NumField(); i++ {
+		field := cfgValue.Type().Field(i)
+		if _, ok := keys[tagName(field, "yaml")]; !ok {
+			continue
+		}
+		if _, ok := os.LookupEnv(tagName(field, "env")); ok {
+			continue
+		}
+		cfgValue.Field(i).Set(fileValue.Field(i))
+	}
+
+	return cfg, nil
+}
+
+// tagName returns the name of the given struct tag, without its options.
+func tagName(field reflect.StructField, key string) string {
+	name, _, _ := strings.Cut(field.Tag.Get(key), ",")
+	return name
+}
+
+// redactConfig returns a copy of cfg where every non-empty field tagged secret:"true" is replaced, and
+// every value of the maps tagged secret:"true".
+func redactConfig(cfg Config) Config {
+	value := reflect.ValueOf(&cfg).Elem()
+	redactValue(value)
+	return cfg
+}
+
+func redactValue(value reflect.Value) {
+	switch value.Kind() {
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			if field.Tag.Get("secret") == "true" && value.Field(i).Kind() == reflect.String {
+				if value.Field(i).String() != "" {
+					value.Field(i).SetString(redactedValue)
+				}
+				continue
+			}
+			if field.Tag.Get("secret") == "true" && value.Field(i).Kind() == reflect.Map {
+				// The keys are kept, only the values are secret, like the values of headers
+				redacted := reflect.MakeMapWithSize(value.Field(i).Type(), value.Field(i).Len())
+				for _, key := range value.Field(i).MapKeys() {
+					redacted.SetMapIndex(key, reflect.ValueOf(redactedValue))
+				}
+				value.Field(i).Set(redacted)
+				continue
+			}
+			redactValue(value.Field(i))
+		}
+	case reflect.Slice:
+		// Copy the slice so the redaction does not leak into the original configuration
+		copied := reflect.MakeSlice(value.Type(), value.Len(), value.Len())
+		reflect.Copy(copied, value)
+		for i := 0; i < copied.Len(); i++ {
+			redactValue(copied.Index(i))
+		}
+		if value.CanSet() {
+			value.Set(copied)
+		}
+	}
+}
+
+// validateConfig runs the configuration validation and prints the effective configuration as YAML.
+func (a *App) validateConfig(w io.Writer) error {
+	if err := a.validateAppConfiguration(); err != nil {
+		return err
+	}
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(redactConfig(a.Config)); err != nil {
+		return fmt.Errorf("failed to encode configuration: %v", err)
+	}
+
+	return encoder.Close()
+}
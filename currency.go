@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// currencyConversion converts the costs of a day from the Kubecost currency to the exported one.
+	currencyConversion struct {
+		from string
+		to   string
+		rate float64
+	}
+
+	// exchangeRateSource returns the rate converting one unit of currency into the target currency
+	// on the given day, and false when it has no rate for them.
+	exchangeRateSource interface {
+		exchangeRate(currency string, d time.Time) (float64, bool, error)
+	}
+
+	// staticExchangeRates is the EXCHANGE_RATES table, the same rates being used for every day.
+	staticExchangeRates map[string]float64
+
+	// fileExchangeRates is a CSV file with date, currency and rate columns, read on every lookup so the
+	// rates of new days can be added while the exporter is running.
+	fileExchangeRates string
+)
+
+// noConversion returns the conversion exporting the costs in their own currency.
+func noConversion(currency string) currencyConversion {
+	return currencyConversion{from: currency, to: currency, rate: 1}
+}
+
+// values returns the Cost and CurrencyCode of a row with the given cost, converted to the target currency,
+// followed by the OriginalCost, OriginalCurrency and ExchangeRate columns with the cost in its original currency.
+func (c currencyConversion) values(cost float64) (string, string, []string) {
+	return strconv.FormatFloat(cost*c.rate, 'f', 5, 64), c.to, []string{
+		strconv.FormatFloat(cost, 'f', 5, 64),
+		c.from,
+		strconv.FormatFloat(c.rate, 'f', -1, 64),
+	}
+}
+
+func (s staticExchangeRates) exchangeRate(currency string, d time.Time) (float64, bool, error) {
+	rate, ok := s[currency]
+	return rate, ok, nil
+}
+
+func (f fileExchangeRates) exchangeRate(currency string, d time.Time) (float64, bool, error) {
+	file, err := os.Open(string(f))
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to open exchange rates file: %v", err)
+	}
+	defer file.Close()
+
+	date := d.Format("2006-01-02")
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 3
+	reader.TrimLeadingSpace = true
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return 0, false, nil
+		}
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to read exchange rates file: %v", err)
+		}
+		if record[0] != date || !strings.EqualFold(record[1], currency) {
+			continue
+		}
+
+		rate, err := strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid exchange rate for %s on %s: %v", currency, date, err)
+		}
+		return rate, true, nil
+	}
+}
+
+// validateCurrencyConversion builds the exchange rate sources of TARGET_CURRENCY, the rates file
+// taking precedence over the static table.
+func (a *App) validateCurrencyConversion() error {
+	a.exchangeRateSources = nil
+	if a.TargetCurrency == "" {
+		return nil
+	}
+
+	if a.ExchangeRatesFile != "" {
+		a.exchangeRateSources = append(a.exchangeRateSources, fileExchangeRates(a.ExchangeRatesFile))
+	}
+	if len(a.ExchangeRates) > 0 {
+		rates := make(staticExchangeRates, len(a.ExchangeRates))
+		for currency, rate := range a.ExchangeRates {
+			if rate <= 0 {
+				return fmt.Errorf("exchange rate: %s must be greater than 0", currency)
+			}
+			rates[strings.ToUpper(currency)] = rate
+		}
+		a.exchangeRateSources = append(a.exchangeRateSources, rates)
+	}
+
+	if len(a.exchangeRateSources) == 0 {
+		return fmt.Errorf("target currency: EXCHANGE_RATES or EXCHANGE_RATES_FILE is required")
+	}
+
+	return nil
+}
+
+// currencyConversion returns the conversion of the costs of the day starting at d from currency to
+// TARGET_CURRENCY. It fails when no source has a rate, so a day is never exported with a mix of currencies.
+func (a *App) currencyConversion(currency string, d time.Time) (currencyConversion, error) {
+	if a.TargetCurrency == "" || strings.EqualFold(currency, a.TargetCurrency) {
+		return noConversion(currency), nil
+	}
+
+	for _, source := range a.exchangeRateSources {
+		rate, ok, err := source.exchangeRate(strings.ToUpper(currency), d)
+		if err != nil {
+			return currencyConversion{}, err
+		}
+		if ok {
+			if rate <= 0 {
+				return currencyConversion{}, fmt.Errorf("exchange rate for %s on %s must be greater than 0", currency, d.Format("2006-01-02"))
+			}
+			return currencyConversion{from: currency, to: a.TargetCurrency, rate: rate}, nil
+		}
+	}
+
+	return currencyConversion{}, fmt.Errorf("no exchange rate from %s to %s on %s", currency, a.TargetCurrency, d.Format("2006-01-02"))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// runDaemon keeps the exporter alive and runs an export and upload cycle on every tick of the
+// configured schedule. The directory lock is held by the caller for the lifetime of the process.
+// On SIGINT or SIGTERM no new cycle or date is started, the date being processed is allowed to
+// finish so its FileWriter is finalized, and the function returns.
+func (a *App) runDaemon() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	a.ctx = ctx
+
+	log.Printf("Running in daemon mode with schedule %q", a.Schedule)
+
+	if a.RunOnStart {
+		a.runCycle()
+	}
+
+	for {
+		next := a.schedule.Next(time.Now())
+		log.Printf("Next export cycle scheduled at %s", next.Format(time.RFC3339))
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			log.Printf("Received shutdown signal, stopping daemon")
+			return
+		case <-timer.C:
+			a.runCycle()
+		}
+	}
+}
+
+// runCycle runs a single export and upload cycle. Unlike the one-shot mode, errors are logged
+// instead of terminating the process, so the next scheduled cycle can retry.
+func (a *App) runCycle() {
+	start := time.Now()
+	log.Printf("Starting export cycle")
+
+	a.setInvoicePeriod(time.Now().Local().AddDate(0, 0, -1))
+	a.cleanupTempFiles()
+	if err := a.updateFileList(); err != nil {
+		log.Printf("Export cycle failed: %v", err)
+		return
+	}
+	if err := a.updateFromKubecost(); err != nil {
+		log.Printf("Export cycle failed: %v", err)
+		return
+	}
+
+	if a.ctx.Err() != nil {
+		log.Printf("Shutdown requested, skipping upload for this cycle")
+		return
+	}
+
+	if err := a.upload(); err != nil {
+		log.Printf("Export cycle finished with errors: %v", err)
+		return
+	}
+
+	log.Printf("Export cycle finished in %s", time.Since(start).Round(time.Second))
+}
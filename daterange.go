@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// dateRange is an inclusive range of days given on the command line as FROM,TO (YYYY-MM-DD,YYYY-MM-DD).
+// The zero value is an empty range.
+type dateRange struct {
+	from time.Time
+	to   time.Time
+}
+
+func (r *dateRange) String() string {
+	if r.isEmpty() {
+		return ""
+	}
+	return r.from.Format("2006-01-02") + "," + r.to.Format("2006-01-02")
+}
+
+func (r *dateRange) Set(value string) error {
+	from, to, found := strings.Cut(value, ",")
+	if !found {
+		return fmt.Errorf("date range %q must be FROM,TO", value)
+	}
+
+	fromDate, err := time.ParseInLocation("2006-01-02", strings.TrimSpace(from), time.Local)
+	if err != nil {
+		return fmt.Errorf("invalid start date: %v", err)
+	}
+
+	toDate, err := time.ParseInLocation("2006-01-02", strings.TrimSpace(to), time.Local)
+	if err != nil {
+		return fmt.Errorf("invalid end date: %v", err)
+	}
+
+	if toDate.Before(fromDate) {
+		return fmt.Errorf("end date %s is before start date %s", to, from)
+	}
+
+	r.from, r.to = fromDate, toDate
+	return nil
+}
+
+func (r *dateRange) isEmpty() bool {
+	return r.from.IsZero()
+}
+
+// contains reports whether the day of d is within the range.
+func (r *dateRange) contains(d time.Time) bool {
+	if r.isEmpty() {
+		return false
+	}
+	day := time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, time.Local)
+	return !day.Before(r.from) && !day.After(r.to)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+type (
+	// KubecostEndpoint is a Kubecost instance the exporter reads from. The name is used in the names
+	// of the files generated from it, so several clusters can be exported into the same directory.
+	// Credentials can be given inline or, to mount them from Kubernetes secrets, as files that are
+	// read on every request so rotated secrets are picked up.
+	KubecostEndpoint struct {
+		Name            string            `json:"name" yaml:"name"`
+		Source          string            `json:"source,omitempty" yaml:"source,omitempty"`
+		Scheme          string            `json:"scheme,omitempty" yaml:"scheme,omitempty"`
+		Host            string            `json:"host" yaml:"host"`
+		APIPath         string            `json:"apiPath" yaml:"apiPath"`
+		ConfigHost      string            `json:"configHost,omitempty" yaml:"configHost,omitempty"`
+		ConfigAPIPath   string            `json:"configApiPath,omitempty" yaml:"configApiPath,omitempty"`
+		CAFile          string            `json:"caFile,omitempty" yaml:"caFile,omitempty"`
+		CertFile        string            `json:"certFile,omitempty" yaml:"certFile,omitempty"`
+		KeyFile         string            `json:"keyFile,omitempty" yaml:"keyFile,omitempty"`
+		BearerToken     string            `json:"bearerToken,omitempty" yaml:"bearerToken,omitempty" secret:"true"`
+		BearerTokenFile string            `json:"bearerTokenFile,omitempty" yaml:"bearerTokenFile,omitempty"`
+		Username        string            `json:"username,omitempty" yaml:"username,omitempty"`
+		Password        string            `json:"password,omitempty" yaml:"password,omitempty" secret:"true"`
+		PasswordFile    string            `json:"passwordFile,omitempty" yaml:"passwordFile,omitempty"`
+		Headers         map[string]string `json:"headers,omitempty" yaml:"headers,omitempty" secret:"true"`
+		HeadersFile     string            `json:"headersFile,omitempty" yaml:"headersFile,omitempty"`
+
+		transport *http.Transport
+	}
+
+	KubecostEndpoints []KubecostEndpoint
+)
+
+var endpointNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// UnmarshalText parses the KUBECOST_ENDPOINTS environment variable, given as a JSON array.
+func (e *KubecostEndpoints) UnmarshalText(text []byte) error {
+	return json.Unmarshal(text, (*[]KubecostEndpoint)(e))
+}
+
+// resolveEndpoints returns the endpoints to export. Without KubecostEndpoints a single unnamed endpoint
+// is built from KubecostHost, so the files keep the kubecost-YYYY-MM-DD.csv.gz naming.
+func (a *App) resolveEndpoints() ([]KubecostEndpoint, error) {
+	if len(a.KubecostEndpoints) == 0 {
+		e := KubecostEndpoint{
+			Source:          a.Source,
+			Scheme:          a.KubecostScheme,
+			Host:            a.KubecostHost,
+			APIPath:         a.KubecostAPIPath,
+			ConfigHost:      cmp.Or(a.KubecostConfigHost, a.KubecostHost),
+			ConfigAPIPath:   cmp.Or(a.KubecostConfigAPIPath, a.KubecostAPIPath),
+			CAFile:          a.KubecostCAFile,
+			CertFile:        a.KubecostCertFile,
+			KeyFile:         a.KubecostKeyFile,
+			BearerTokenFile: a.KubecostBearerTokenFile,
+			Username:        a.KubecostUsername,
+			PasswordFile:    a.KubecostPasswordFile,
+			HeadersFile:     a.KubecostHeadersFile,
+		}
+		if err := e.init(); err != nil {
+			return nil, fmt.Errorf("kubecost: %v", err)
+		}
+		return []KubecostEndpoint{e}, nil
+	}
+
+	names := make(map[string]struct{}, len(a.KubecostEndpoints))
+	endpoints := make([]KubecostEndpoint, 0, len(a.KubecostEndpoints))
+	for _, e := range a.KubecostEndpoints {
+		if !endpointNameRe.MatchString(e.Name) {
+			return nil, fmt.Errorf("kubecost endpoint name: %q must only contain letters, digits, '-' and '_'", e.Name)
+		}
+		if _, ok := names[e.Name]; ok {
+			return nil, fmt.Errorf("kubecost endpoint name: %q is used more than once", e.Name)
+		}
+		names[e.Name] = struct{}{}
+
+		if e.Host == "" {
+			return nil, fmt.Errorf("kubecost endpoint %s: host is required", e.Name)
+		}
+		e.Source = cmp.Or(e.Source, a.Source)
+		e.APIPath = cmp.Or(e.APIPath, a.KubecostAPIPath)
+		e.ConfigHost = cmp.Or(e.ConfigHost, e.Host)
+		e.ConfigAPIPath = cmp.Or(e.ConfigAPIPath, e.APIPath)
+		if err := e.init(); err != nil {
+			return nil, fmt.Errorf("kubecost endpoint %s: %v", e.Name, err)
+		}
+		endpoints = append(endpoints, e)
+	}
+
+	return endpoints, nil
+}
+
+// init validates the source and the scheme, and builds the TLS transport of the endpoint when it needs a custom CA
+// or a client certificate. Other endpoints use the default client of the App.
+func (e *KubecostEndpoint) init() error {
+	e.Source = cmp.Or(e.Source, sourceKubecost)
+	switch e.Source {
+	case sourceKubecost, sourceOpenCost:
+	default:
+		return fmt.Errorf("source: %s is wrong", e.Source)
+	}
+
+	e.Scheme = cmp.Or(e.Scheme, "http")
+	if e.Scheme != "http" && e.Scheme != "https" {
+		return fmt.Errorf("scheme: %s is wrong", e.Scheme)
+	}
+
+	if e.CAFile == "" && e.CertFile == "" && e.KeyFile == "" {
+		return nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if e.CAFile != "" {
+		caCert, err := os.ReadFile(e.CAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read CA file: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return fmt.Errorf("no certificate found in CA file %s", e.CAFile)
+		}
+	}
+
+	if e.CertFile != "" || e.KeyFile != "" {
+		if e.CertFile == "" || e.KeyFile == "" {
+			return fmt.Errorf("both a client certificate and a key file are required for mTLS")
+		}
+		if _, err := tls.LoadX509KeyPair(e.CertFile, e.KeyFile); err != nil {
+			return fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		// The key pair is read again at each handshake, so a certificate rotated by cert-manager is used
+		// by the next connections without restarting the exporter
+		certFile, keyFile := e.CertFile, e.KeyFile
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load client certificate: %v", err)
+			}
+			return &cert, nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	e.transport = transport
+
+	return nil
+}
+
+// label returns the endpoint name for log messages.
+func (e KubecostEndpoint) label() string {
+	if e.Name == "" {
+		return e.Host
+	}
+	return e.Name
+}
+
+// fileName returns the name of the first file generated from the endpoint for the given date, with
+// the extension of the output format.
+func (e KubecostEndpoint) fileName(date, extension string) string {
+	if e.Name == "" {
+		return fmt.Sprintf("kubecost-%s%s", date, extension)
+	}
+	return fmt.Sprintf("kubecost-%s-%s%s", e.Name, date, extension)
+}
+
+// url returns the URL of an API of the endpoint, host being either Host or ConfigHost.
+func (e KubecostEndpoint) url(host, apiPath, elem string) (string, error) {
+	return url.JoinPath(fmt.Sprintf("%s://%s", cmp.Or(e.Scheme, "http"), host), apiPath, elem)
+}
+
+// newRequest builds a GET request to the endpoint with its headers and credentials.
+func (e KubecostEndpoint) newRequest(reqURL string) (*http.Request, error) {
+	request, err := http.NewRequest(http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.HeadersFile != "" {
+		headers, err := readHeadersFile(e.HeadersFile)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range headers {
+			request.Header.Set(name, value)
+		}
+	}
+	for name, value := range e.Headers {
+		request.Header.Set(name, value)
+	}
+
+	bearerToken, err := readSecret(e.BearerToken, e.BearerTokenFile)
+	if err != nil {
+		return nil, err
+	}
+	password, err := readSecret(e.Password, e.PasswordFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if bearerToken != "" {
+		request.Header.Set("Authorization", "Bearer "+bearerToken)
+	} else if e.Username != "" {
+		request.SetBasicAuth(e.Username, password)
+	}
+
+	return request, nil
+}
+
+// kubecostClient returns the HTTP client to use for the requests to the endpoint.
+func (a *App) kubecostClient(e KubecostEndpoint) *http.Client {
+	if e.transport == nil {
+		return a.client
+	}
+	return &http.Client{Transport: e.transport, Timeout: a.client.Timeout}
+}
+
+// readSecret returns value, or the trimmed content of file when it is set.
+func readSecret(value, file string) (string, error) {
+	if file == "" {
+		return value, nil
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %v", err)
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
+
+// readHeadersFile reads the headers to add to the Kubecost requests from a file with one
+// "Name: value" header per line. Empty lines and lines starting with # are ignored.
+func readHeadersFile(file string) (map[string]string, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read headers file: %v", err)
+	}
+
+	headers := make(map[string]string)
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid header on line %d of headers file %s", i+1, file)
+		}
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+
+	return headers, nil
+}
+
+// parseFileName returns the endpoint name and the date, formatted as YYYY-MM-DD, of a file generated
+// by the exporter. The endpoint name is empty for files of the default endpoint.
+func parseFileName(fileName string) (endpoint, date string, ok bool) {
+	matches := fileNameRe.FindStringSubmatch(filepath.Base(fileName))
+	if matches == nil {
+		return "", "", false
+	}
+	return matches[1], matches[2], true
+}
@@ -8,29 +8,56 @@ import (
 	"log"
 	"os"
 	"strings"
+
+	"github.com/parquet-go/parquet-go"
 )
 
-type FileWriter struct {
-	app          *App
-	file         *os.File
-	bufferedFile *bufio.Writer
-	zipWriter    *gzip.Writer
-	csvWriter    *csv.Writer
-	filePath     string
-	baseFilePath string
-	tempFilePath string
-	rowCount     int
-	fileIndex    int
-	isFinalized  bool
-}
+type (
+	FileWriter struct {
+		app          *App
+		file         *os.File
+		bufferedFile *bufio.Writer
+		zipWriter    *gzip.Writer
+		csvWriter    *csv.Writer
+		parquetRows  *parquetRowType
+		parquetFile  *parquet.Writer
+		extension    string
+		filePath     string
+		baseFilePath string
+		tempFilePath string
+		rowCount     int
+		fileIndex    int
+		isFinalized  bool
+		pendingFiles []pendingFile
+		files        []string // final paths of the finalized files
+	}
+
+	// pendingFile is a rotated file that is complete but stays under its temp name until the
+	// whole day is finalized, so a failed stream never replaces an existing file.
+	pendingFile struct {
+		tempFilePath string
+		filePath     string
+		rowCount     int
+	}
+)
 
 func newFileWriter(app *App, filePath string) (*FileWriter, error) {
+	extension := app.fileExtension()
 	fw := &FileWriter{
 		app:          app,
-		baseFilePath: strings.TrimSuffix(filePath, ".csv.gz"),
+		extension:    extension,
+		baseFilePath: strings.TrimSuffix(filePath, extension),
 		fileIndex:    1,
 	}
 
+	if app.OutputFormat == outputFormatParquet {
+		parquetRows, err := newParquetRowType(app.getCSVHeaders())
+		if err != nil {
+			return nil, err
+		}
+		fw.parquetRows = parquetRows
+	}
+
 	err := fw.initFile(filePath)
 	if err != nil {
 		return nil, err
@@ -50,8 +77,14 @@ func (fw *FileWriter) initFile(filePath string) error {
 
 	fw.file = file
 	fw.bufferedFile = bufio.NewWriterSize(file, 1<<20)
-	fw.zipWriter = gzip.NewWriter(fw.bufferedFile)
-	fw.csvWriter = csv.NewWriter(fw.zipWriter)
+	if fw.parquetRows != nil {
+		// A Parquet file holds the whole day, MAX_FILE_ROWS bounds its row groups instead
+		fw.parquetFile = parquet.NewWriter(fw.bufferedFile, fw.parquetRows.schema,
+			parquet.MaxRowsPerRowGroup(int64(fw.app.MaxFileRows)), parquet.Compression(&parquet.Snappy))
+	} else {
+		fw.zipWriter = gzip.NewWriter(fw.bufferedFile)
+		fw.csvWriter = csv.NewWriter(fw.zipWriter)
+	}
 	fw.rowCount = 0
 	fw.isFinalized = false
 
@@ -59,15 +92,33 @@ func (fw *FileWriter) initFile(filePath string) error {
 }
 
 func (fw *FileWriter) writeHeaders(headers []string) error {
+	// The columns of a Parquet file are in its schema
+	if fw.parquetFile != nil {
+		return nil
+	}
 	if fw.csvWriter == nil {
 		return fmt.Errorf("file writer not initialized")
 	}
 	return fw.csvWriter.Write(headers)
 }
 
-func (fw *FileWriter) writeRow(row []string, monthOfData string, filesToUpload map[string]map[string]struct{}) error {
+func (fw *FileWriter) writeRow(row []string) error {
+	if fw.parquetFile != nil {
+		value, err := fw.parquetRows.value(row)
+		if err != nil {
+			return fmt.Errorf("failed to convert Parquet row: %v", err)
+		}
+		if err := fw.parquetFile.Write(value); err != nil {
+			return fmt.Errorf("failed to write Parquet row: %v", err)
+		}
+
+		fw.rowCount++
+		rowsWritten.Inc()
+		return nil
+	}
+
 	if fw.rowCount >= fw.app.MaxFileRows {
-		err := fw.rotateFile(monthOfData, filesToUpload)
+		err := fw.rotateFile()
 		if err != nil {
 			return err
 		}
@@ -88,17 +139,25 @@ func (fw *FileWriter) writeRow(row []string, monthOfData string, filesToUpload m
 	}
 
 	fw.rowCount++
+	rowsWritten.Inc()
 	return nil
 }
 
-func (fw *FileWriter) rotateFile(monthOfData string, filesToUpload map[string]map[string]struct{}) error {
-	err := fw.finalizeFile(monthOfData, filesToUpload)
+func (fw *FileWriter) rotateFile() error {
+	err := fw.close()
 	if err != nil {
-		return fmt.Errorf("failed to finalize file during rotation: %v", err)
+		return fmt.Errorf("failed to close file during rotation: %v", err)
 	}
 
+	if fw.rowCount > 0 {
+		fw.pendingFiles = append(fw.pendingFiles, pendingFile{tempFilePath: fw.tempFilePath, filePath: fw.filePath, rowCount: fw.rowCount})
+	} else {
+		fw.cleanup()
+	}
+
+	fileRotations.Inc()
 	fw.fileIndex++
-	newFilePath := fmt.Sprintf("%s-%d.csv.gz", fw.baseFilePath, fw.fileIndex)
+	newFilePath := fmt.Sprintf("%s-%d%s", fw.baseFilePath, fw.fileIndex, fw.extension)
 
 	err = fw.initFile(newFilePath)
 	if err != nil {
@@ -108,31 +167,44 @@ func (fw *FileWriter) rotateFile(monthOfData string, filesToUpload map[string]ma
 	return nil
 }
 
+// finalizeFile renames the current file and every file rotated before it to their final names,
+// and adds them to filesToUpload.
 func (fw *FileWriter) finalizeFile(monthOfData string, filesToUpload map[string]map[string]struct{}) error {
 	err := fw.close()
 	if err != nil {
-		fw.cleanup()
+		fw.discard()
 		return fmt.Errorf("failed to close file during finalization: %v", err)
 	}
 
 	if fw.rowCount > 0 {
-		err = os.Rename(fw.tempFilePath, fw.filePath)
+		fw.pendingFiles = append(fw.pendingFiles, pendingFile{tempFilePath: fw.tempFilePath, filePath: fw.filePath, rowCount: fw.rowCount})
+	} else {
+		fw.cleanup()
+	}
+
+	// Several dates may be finalized concurrently into the same filesToUpload
+	fw.app.filesMutex.Lock()
+	defer fw.app.filesMutex.Unlock()
+
+	for i, pf := range fw.pendingFiles {
+		err = os.Rename(pf.tempFilePath, pf.filePath)
 		if err != nil {
-			fw.cleanup()
+			fw.pendingFiles = fw.pendingFiles[i:]
+			fw.discard()
 			return fmt.Errorf("failed to rename temp file to final: %v", err)
 		}
 
-		fw.isFinalized = true
-
 		if filesToUpload[monthOfData] == nil {
 			filesToUpload[monthOfData] = make(map[string]struct{})
 		}
-		filesToUpload[monthOfData][fw.filePath] = struct{}{}
-		log.Printf("Generated file: %s (%d rows)", fw.filePath, fw.rowCount)
-	} else {
-		fw.cleanup()
+		filesToUpload[monthOfData][pf.filePath] = struct{}{}
+		fw.files = append(fw.files, pf.filePath)
+		log.Printf("Generated file: %s (%d rows)", pf.filePath, pf.rowCount)
 	}
 
+	fw.pendingFiles = nil
+	fw.isFinalized = true
+
 	return nil
 }
 
@@ -146,6 +218,12 @@ func (fw *FileWriter) close() error {
 		}
 	}
 
+	if fw.parquetFile != nil {
+		if err := fw.parquetFile.Close(); err != nil {
+			errors = append(errors, fmt.Errorf("failed to close Parquet writer: %v", err))
+		}
+	}
+
 	if fw.zipWriter != nil {
 		if err := fw.zipWriter.Close(); err != nil {
 			errors = append(errors, fmt.Errorf("failed to close gzip writer: %v", err))
@@ -171,6 +249,7 @@ func (fw *FileWriter) close() error {
 	fw.bufferedFile = nil
 	fw.zipWriter = nil
 	fw.csvWriter = nil
+	fw.parquetFile = nil
 
 	if len(errors) > 0 {
 		var errorMessages []string
@@ -191,6 +270,23 @@ func (fw *FileWriter) cleanup() {
 	}
 }
 
+// discard closes the writer and removes the current and rotated temp files that were not finalized.
+// It is a no-op once the files have been finalized.
+func (fw *FileWriter) discard() {
+	if err := fw.close(); err != nil {
+		log.Printf("Warning: failed to close file writer: %v", err)
+	}
+
+	fw.cleanup()
+
+	for _, pf := range fw.pendingFiles {
+		if err := os.Remove(pf.tempFilePath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: failed to cleanup temp file %s: %v", pf.tempFilePath, err)
+		}
+	}
+	fw.pendingFiles = nil
+}
+
 func validateGzipHeaders(filePath string) error {
 	file, err := os.Open(filePath)
 	if err != nil {
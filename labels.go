@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// labelRules filters and renames the labels of the rows before they are encoded. The zero value
+// keeps the labels unchanged.
+type labelRules struct {
+	include   *regexp.Regexp
+	exclude   *regexp.Regexp
+	renames   map[string]string
+	lowercase bool
+	replacer  *strings.Replacer
+}
+
+// validateLabelRules compiles LABELS_INCLUDE and LABELS_EXCLUDE and parses the LABEL_RENAMES, given
+// as from=to pairs.
+func (a *App) validateLabelRules() error {
+	rules := labelRules{lowercase: a.LabelKeysLowercase}
+
+	if a.LabelsInclude != "" {
+		include, err := regexp.Compile(a.LabelsInclude)
+		if err != nil {
+			return fmt.Errorf("labels include: %v", err)
+		}
+		rules.include = include
+	}
+	if a.LabelsExclude != "" {
+		exclude, err := regexp.Compile(a.LabelsExclude)
+		if err != nil {
+			return fmt.Errorf("labels exclude: %v", err)
+		}
+		rules.exclude = exclude
+	}
+
+	for _, rename := range a.LabelRenames {
+		from, to, ok := strings.Cut(rename, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return fmt.Errorf("label rename: %q must be given as from=to", rename)
+		}
+		if rules.renames == nil {
+			rules.renames = make(map[string]string, len(a.LabelRenames))
+		}
+		rules.renames[from] = to
+	}
+
+	if a.LabelKeysReplaceChars != "" {
+		oldnew := make([]string, 0, 2*len(a.LabelKeysReplaceChars))
+		for _, c := range a.LabelKeysReplaceChars {
+			oldnew = append(oldnew, string(c), "_")
+		}
+		rules.replacer = strings.NewReplacer(oldnew...)
+	}
+
+	a.labelRules = rules
+	return nil
+}
+
+func (r labelRules) empty() bool {
+	return r.include == nil && r.exclude == nil && len(r.renames) == 0 && !r.lowercase && r.replacer == nil
+}
+
+// apply returns the labels kept by the include and exclude filters, matched against the original keys,
+// under their renamed or normalized keys. When several labels end up with the same key, the label with
+// the smallest original key wins, so the result does not depend on the map order.
+func (r labelRules) apply(labels map[string]string) map[string]string {
+	if r.empty() {
+		return labels
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	result := make(map[string]string, len(labels))
+	for _, k := range keys {
+		if r.include != nil && !r.include.MatchString(k) {
+			continue
+		}
+		if r.exclude != nil && r.exclude.MatchString(k) {
+			continue
+		}
+
+		key := r.renameKey(k)
+		if _, ok := result[key]; ok {
+			continue
+		}
+		result[key] = labels[k]
+	}
+
+	return result
+}
+
+// renameKey returns the LABEL_RENAMES target of key, or otherwise key normalized by the lowercase
+// and character replacement rules.
+func (r labelRules) renameKey(key string) string {
+	if to, ok := r.renames[key]; ok {
+		return to
+	}
+	if r.lowercase {
+		key = strings.ToLower(key)
+	}
+	if r.replacer != nil {
+		key = r.replacer.Replace(key)
+	}
+	return key
+}
+
+type (
+	// DerivedLabel is a label computed from the first source of an ordered fallback chain that has a
+	// value, or from Default when none has.
+	DerivedLabel struct {
+		Name    string               `json:"name" yaml:"name"`
+		Sources []DerivedLabelSource `json:"sources" yaml:"sources"`
+		Default string               `json:"default,omitempty" yaml:"default,omitempty"`
+	}
+
+	// DerivedLabelSource is one step of a fallback chain. Exactly one of its fields is set: a pod label
+	// key, a namespace label key, or a regular expression on the namespace name whose first capture
+	// group, or whole match when it has no group, is the value.
+	DerivedLabelSource struct {
+		PodLabel       string `json:"podLabel,omitempty" yaml:"podLabel,omitempty"`
+		NamespaceLabel string `json:"namespaceLabel,omitempty" yaml:"namespaceLabel,omitempty"`
+		Namespace      string `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+
+		namespaceRe *regexp.Regexp
+	}
+
+	DerivedLabels []DerivedLabel
+)
+
+// UnmarshalText parses the DERIVED_LABELS environment variable, given as a JSON array.
+func (d *DerivedLabels) UnmarshalText(text []byte) error {
+	return json.Unmarshal(text, (*[]DerivedLabel)(d))
+}
+
+// resolveDerivedLabels validates the DerivedLabels and returns them with their namespace regular
+// expressions compiled.
+func (a *App) resolveDerivedLabels() ([]DerivedLabel, error) {
+	names := make(map[string]struct{}, len(a.DerivedLabels))
+	derivedLabels := make([]DerivedLabel, 0, len(a.DerivedLabels))
+	for _, d := range a.DerivedLabels {
+		if d.Name == "" {
+			return nil, fmt.Errorf("derived label: name is required")
+		}
+		if _, ok := names[d.Name]; ok {
+			return nil, fmt.Errorf("derived label: %q is defined more than once", d.Name)
+		}
+		names[d.Name] = struct{}{}
+
+		sources := make([]DerivedLabelSource, 0, len(d.Sources))
+		for i, source := range d.Sources {
+			set := 0
+			for _, field := range []string{source.PodLabel, source.NamespaceLabel, source.Namespace} {
+				if field != "" {
+					set++
+				}
+			}
+			if set != 1 {
+				return nil, fmt.Errorf("derived label %s: source %d must set exactly one of podLabel, namespaceLabel and namespace", d.Name, i+1)
+			}
+
+			if source.Namespace != "" {
+				re, err := regexp.Compile(source.Namespace)
+				if err != nil {
+					return nil, fmt.Errorf("derived label %s: source %d: %v", d.Name, i+1, err)
+				}
+				source.namespaceRe = re
+			}
+			sources = append(sources, source)
+		}
+		d.Sources = sources
+		derivedLabels = append(derivedLabels, d)
+	}
+
+	return derivedLabels, nil
+}
+
+// value returns the value of the derived label for the given properties, and false when no source
+// has a value and there is no default.
+func (d DerivedLabel) value(properties Properties) (string, bool) {
+	for _, source := range d.Sources {
+		var value string
+		switch {
+		case source.PodLabel != "":
+			value = properties.Labels[source.PodLabel]
+		case source.NamespaceLabel != "":
+			value = properties.NamespaceLabels[source.NamespaceLabel]
+		case source.namespaceRe != nil:
+			if matches := source.namespaceRe.FindStringSubmatch(properties.Namespace); matches != nil {
+				value = matches[0]
+				if len(matches) > 1 {
+					value = matches[1]
+				}
+			}
+		}
+		if value != "" {
+			return value, true
+		}
+	}
+
+	return d.Default, d.Default != ""
+}
+
+// deriveLabels computes the derived labels of an allocation. It must be called before mergeLabels,
+// which adds the namespace labels to the pod labels.
+func (a *App) deriveLabels(properties Properties) map[string]string {
+	if len(a.derivedLabels) == 0 {
+		return nil
+	}
+
+	derived := make(map[string]string, len(a.derivedLabels))
+	for _, d := range a.derivedLabels {
+		if value, ok := d.value(properties); ok {
+			derived[d.Name] = value
+		}
+	}
+	return derived
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -13,12 +15,15 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/caarlos0/env/v11"
+	"github.com/robfig/cron/v3"
 )
 
 type (
@@ -112,189 +117,373 @@ type (
 	}
 
 	Config struct {
-		RefreshToken                string  `env:"REFRESH_TOKEN"`
-		ServiceClientID             string  `env:"SERVICE_APP_CLIENT_ID"`
-		ServiceClientSecret         string  `env:"SERVICE_APP_CLIENT_SECRET"`
-		OrgID                       string  `env:"ORG_ID"`
-		BillConnectID               string  `env:"BILL_CONNECT_ID"`
-		Shard                       string  `env:"SHARD" envDefault:"NAM"`
-		KubecostHost                string  `env:"KUBECOST_HOST" envDefault:"localhost:9090"`
-		KubecostAPIPath             string  `env:"KUBECOST_API_PATH" envDefault:"/model/"`
-		KubecostConfigHost          string  `env:"KUBECOST_CONFIG_HOST"`
-		KubecostConfigAPIPath       string  `env:"KUBECOST_CONFIG_API_PATH"`
-		Aggregation                 string  `env:"AGGREGATION" envDefault:"pod"`
-		ShareNamespaces             string  `env:"SHARE_NAMESPACES" envDefault:"kube-system,cadvisor"`
-		Idle                        bool    `env:"IDLE" envDefault:"true"`
-		IdleByNode                  bool    `env:"IDLE_BY_NODE" envDefault:"false"`
-		ShareIdle                   bool    `env:"SHARE_IDLE" envDefault:"false"`
-		ShareTenancyCosts           bool    `env:"SHARE_TENANCY_COSTS" envDefault:"true"`
-		Multiplier                  float64 `env:"MULTIPLIER" envDefault:"1.0"`
-		FileRotation                bool    `env:"FILE_ROTATION" envDefault:"true"`
-		FilePath                    string  `env:"FILE_PATH" envDefault:"/var/kubecost"`
-		IncludePreviousMonth        bool    `env:"INCLUDE_PREVIOUS_MONTH" envDefault:"true"`
-		RequestTimeout              int     `env:"REQUEST_TIMEOUT" envDefault:"5"`
-		MaxFileRows                 int     `env:"MAX_FILE_ROWS" envDefault:"1000000"`
-		CreateBillConnectIfNotExist bool    `env:"CREATE_BILL_CONNECT_IF_NOT_EXIST" envDefault:"false"`
-		VendorName                  string  `env:"VENDOR_NAME" envDefault:"Kubecost"`
-		PageSize                    int     `env:"PAGE_SIZE" envDefault:"500"`
-		DefaultCurrency             string  `env:"DEFAULT_CURRENCY" envDefault:"USD"`
-		OverridePodLabels           bool    `env:"OVERRIDE_POD_LABELS" envDefault:"true"`
+		RefreshToken                string             `env:"REFRESH_TOKEN" yaml:"refreshToken" secret:"true"`
+		ServiceClientID             string             `env:"SERVICE_APP_CLIENT_ID" yaml:"serviceAppClientId"`
+		ServiceClientSecret         string             `env:"SERVICE_APP_CLIENT_SECRET" yaml:"serviceAppClientSecret" secret:"true"`
+		OrgID                       string             `env:"ORG_ID" yaml:"orgId"`
+		BillConnectID               string             `env:"BILL_CONNECT_ID" yaml:"billConnectId"`
+		Shard                       string             `env:"SHARD" envDefault:"NAM" yaml:"shard"`
+		KubecostHost                string             `env:"KUBECOST_HOST" envDefault:"localhost:9090" yaml:"kubecostHost"`
+		KubecostAPIPath             string             `env:"KUBECOST_API_PATH" envDefault:"/model/" yaml:"kubecostApiPath"`
+		KubecostConfigHost          string             `env:"KUBECOST_CONFIG_HOST" yaml:"kubecostConfigHost"`
+		KubecostConfigAPIPath       string             `env:"KUBECOST_CONFIG_API_PATH" yaml:"kubecostConfigApiPath"`
+		KubecostScheme              string             `env:"KUBECOST_SCHEME" envDefault:"http" yaml:"kubecostScheme"`
+		KubecostCAFile              string             `env:"KUBECOST_CA_FILE" yaml:"kubecostCaFile"`
+		KubecostCertFile            string             `env:"KUBECOST_CERT_FILE" yaml:"kubecostCertFile"`
+		KubecostKeyFile             string             `env:"KUBECOST_KEY_FILE" yaml:"kubecostKeyFile"`
+		KubecostBearerTokenFile     string             `env:"KUBECOST_BEARER_TOKEN_FILE" yaml:"kubecostBearerTokenFile"`
+		KubecostUsername            string             `env:"KUBECOST_USERNAME" yaml:"kubecostUsername"`
+		KubecostPasswordFile        string             `env:"KUBECOST_PASSWORD_FILE" yaml:"kubecostPasswordFile"`
+		KubecostHeadersFile         string             `env:"KUBECOST_HEADERS_FILE" yaml:"kubecostHeadersFile"`
+		KubecostEndpoints           KubecostEndpoints  `env:"KUBECOST_ENDPOINTS" yaml:"kubecostEndpoints"`
+		Aggregation                 string             `env:"AGGREGATION" envDefault:"pod" yaml:"aggregation"`
+		ShareNamespaces             string             `env:"SHARE_NAMESPACES" envDefault:"kube-system,cadvisor" yaml:"shareNamespaces"`
+		Idle                        bool               `env:"IDLE" envDefault:"true" yaml:"idle"`
+		IdleByNode                  bool               `env:"IDLE_BY_NODE" envDefault:"false" yaml:"idleByNode"`
+		ShareIdle                   bool               `env:"SHARE_IDLE" envDefault:"false" yaml:"shareIdle"`
+		ShareTenancyCosts           bool               `env:"SHARE_TENANCY_COSTS" envDefault:"true" yaml:"shareTenancyCosts"`
+		Multiplier                  float64            `env:"MULTIPLIER" envDefault:"1.0" yaml:"multiplier"`
+		FileRotation                bool               `env:"FILE_ROTATION" envDefault:"true" yaml:"fileRotation"`
+		FilePath                    string             `env:"FILE_PATH" envDefault:"/var/kubecost" yaml:"filePath"`
+		IncludePreviousMonth        bool               `env:"INCLUDE_PREVIOUS_MONTH" envDefault:"true" yaml:"includePreviousMonth"`
+		RequestTimeout              int                `env:"REQUEST_TIMEOUT" envDefault:"5" yaml:"requestTimeout"`
+		MaxFileRows                 int                `env:"MAX_FILE_ROWS" envDefault:"1000000" yaml:"maxFileRows"`
+		CreateBillConnectIfNotExist bool               `env:"CREATE_BILL_CONNECT_IF_NOT_EXIST" envDefault:"false" yaml:"createBillConnectIfNotExist"`
+		VendorName                  string             `env:"VENDOR_NAME" envDefault:"Kubecost" yaml:"vendorName"`
+		PageSize                    int                `env:"PAGE_SIZE" envDefault:"500" yaml:"pageSize"`
+		DefaultCurrency             string             `env:"DEFAULT_CURRENCY" envDefault:"USD" yaml:"defaultCurrency"`
+		OverridePodLabels           bool               `env:"OVERRIDE_POD_LABELS" envDefault:"true" yaml:"overridePodLabels"`
+		Schedule                    string             `env:"SCHEDULE" envDefault:"0 */24 * * *" yaml:"schedule"`
+		RunOnStart                  bool               `env:"RUN_ON_START" envDefault:"true" yaml:"runOnStart"`
+		MetricsAddress              string             `env:"METRICS_ADDRESS" yaml:"metricsAddress"`
+		RetryMaxAttempts            int                `env:"RETRY_MAX_ATTEMPTS" envDefault:"5" yaml:"retryMaxAttempts"`
+		RetryBaseDelay              time.Duration      `env:"RETRY_BASE_DELAY" envDefault:"2s" yaml:"retryBaseDelay"`
+		RetryMaxDelay               time.Duration      `env:"RETRY_MAX_DELAY" envDefault:"2m" yaml:"retryMaxDelay"`
+		Concurrency                 int                `env:"CONCURRENCY" envDefault:"1" yaml:"concurrency"`
+		DryRun                      bool               `env:"DRY_RUN" envDefault:"false" yaml:"dryRun"`
+		SettledAfterDays            int                `env:"SETTLED_AFTER_DAYS" envDefault:"0" yaml:"settledAfterDays"`
+		Source                      string             `env:"SOURCE" envDefault:"kubecost" yaml:"source"`
+		ExportAssets                bool               `env:"EXPORT_ASSETS" envDefault:"false" yaml:"exportAssets"`
+		ExportCloudCosts            bool               `env:"EXPORT_CLOUD_COSTS" envDefault:"false" yaml:"exportCloudCosts"`
+		CloudCostMetric             string             `env:"CLOUD_COST_METRIC" envDefault:"amortizedNetCost" yaml:"cloudCostMetric"`
+		CloudCostLabels             []string           `env:"CLOUD_COST_LABELS" envSeparator:"," envDefault:"kubernetes_namespace" yaml:"cloudCostLabels"`
+		CloudCostNamespaceLabel     string             `env:"CLOUD_COST_NAMESPACE_LABEL" envDefault:"kubernetes_namespace" yaml:"cloudCostNamespaceLabel"`
+		Resolution                  string             `env:"RESOLUTION" envDefault:"1d" yaml:"resolution"`
+		Columns                     []string           `env:"COLUMNS" envSeparator:"," yaml:"columns"`
+		LabelColumns                []string           `env:"LABEL_COLUMNS" envSeparator:"," yaml:"labelColumns"`
+		LabelColumnDefault          string             `env:"LABEL_COLUMN_DEFAULT" yaml:"labelColumnDefault"`
+		LabelsInclude               string             `env:"LABELS_INCLUDE" yaml:"labelsInclude"`
+		LabelsExclude               string             `env:"LABELS_EXCLUDE" yaml:"labelsExclude"`
+		LabelRenames                []string           `env:"LABEL_RENAMES" envSeparator:"," yaml:"labelRenames"`
+		LabelKeysLowercase          bool               `env:"LABEL_KEYS_LOWERCASE" envDefault:"false" yaml:"labelKeysLowercase"`
+		LabelKeysReplaceChars       string             `env:"LABEL_KEYS_REPLACE_CHARS" yaml:"labelKeysReplaceChars"`
+		DerivedLabels               DerivedLabels      `env:"DERIVED_LABELS" yaml:"derivedLabels"`
+		MultiplierRules             MultiplierRules    `env:"MULTIPLIER_RULES" yaml:"multiplierRules"`
+		TargetCurrency              string             `env:"TARGET_CURRENCY" yaml:"targetCurrency"`
+		ExchangeRates               map[string]float64 `env:"EXCHANGE_RATES" envKeyValSeparator:"=" yaml:"exchangeRates"`
+		ExchangeRatesFile           string             `env:"EXCHANGE_RATES_FILE" yaml:"exchangeRatesFile"`
+		OutputFormat                string             `env:"OUTPUT_FORMAT" envDefault:"csv" yaml:"outputFormat"`
+		Reconcile                   bool               `env:"RECONCILE" envDefault:"false" yaml:"reconcile"`
+		ReconcileTolerance          float64            `env:"RECONCILE_TOLERANCE" envDefault:"0.01" yaml:"reconcileTolerance"`
+		Sinks                       []string           `env:"SINKS" envSeparator:"," envDefault:"flexera" yaml:"sinks"`
+		UploadManifest              bool               `env:"UPLOAD_MANIFEST" envDefault:"false" yaml:"uploadManifest"`
+		SinkDirectory               string             `env:"SINK_DIRECTORY" yaml:"sinkDirectory"`
+		S3Endpoint                  string             `env:"S3_ENDPOINT" yaml:"s3Endpoint"`
+		S3Region                    string             `env:"S3_REGION" envDefault:"us-east-1" yaml:"s3Region"`
+		S3Bucket                    string             `env:"S3_BUCKET" yaml:"s3Bucket"`
+		S3Prefix                    string             `env:"S3_PREFIX" yaml:"s3Prefix"`
+		S3PathStyle                 bool               `env:"S3_PATH_STYLE" envDefault:"false" yaml:"s3PathStyle"`
+		S3AccessKeyID               string             `env:"S3_ACCESS_KEY_ID" yaml:"s3AccessKeyId"`
+		S3SecretAccessKey           string             `env:"S3_SECRET_ACCESS_KEY" yaml:"s3SecretAccessKey" secret:"true"`
+		S3SecretAccessKeyFile       string             `env:"S3_SECRET_ACCESS_KEY_FILE" yaml:"s3SecretAccessKeyFile"`
+		S3SessionToken              string             `env:"S3_SESSION_TOKEN" yaml:"s3SessionToken" secret:"true"`
 	}
 
 	App struct {
 		Config
+		ctx                                context.Context
+		schedule                           cron.Schedule
 		lockFile                           *os.File
 		aggregation                        string
+		endpoints                          []KubecostEndpoint
+		labelColumns                       []labelColumn
+		labelRules                         labelRules
+		derivedLabels                      []DerivedLabel
+		multiplierRules                    []MultiplierRule
+		exchangeRateSources                []exchangeRateSource
+		filesMutex                         sync.Mutex
 		filesToUpload                      map[string]map[string]struct{}
+		unreconciledMonths                 map[string]struct{}
+		cloudCostsMutex                    sync.Mutex
+		cloudCostRequests                  map[string]*cloudCostsRequest
 		client                             *http.Client
 		lastInvoiceDate                    time.Time
 		invoiceMonths                      []string
 		mandatoryFileSavingPeriodStartDate time.Time
 		billUploadURL                      string
+		forceRefresh                       dateRange
 	}
 )
 
 const lockFileName = ".kubecost-exporter.lock"
 
 var uuidPattern = regexp.MustCompile(`an existing billUpload \(ID: ([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})`)
-var fileNameRe = regexp.MustCompile(`kubecost-(\d{4}-\d{2}-\d{2})(?:-(\d+))?\.csv(\.gz)?`)
+var fileNameRe = regexp.MustCompile(`^kubecost-(?:([A-Za-z0-9_-]+)-)?(\d{4}-\d{2}-\d{2})(?:-(\d+))?\.(?:csv(\.gz)?|parquet)$`)
 
 func main() {
+	daemon := flag.Bool("daemon", false, "keep running and execute the export and upload cycle on SCHEDULE")
+	var forceRefresh dateRange
+	flag.Var(&forceRefresh, "force-refresh", "re-export settled days in the range `FROM,TO` (YYYY-MM-DD,YYYY-MM-DD)")
+	flag.StringVar(&configFile, "config", configFile, "YAML or JSON configuration `file`, environment variables override its values")
+	flag.Parse()
+
+	var backfillRange dateRange
+	switch flag.Arg(0) {
+	case "":
+	case "backfill":
+		r, err := parseBackfillArgs(flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		backfillRange = r
+	case "validate-config":
+		// The configuration is validated by validateConfig, so its error is reported instead of newApp's
+		a, err := loadApp()
+		if err == nil {
+			err = a.validateConfig(os.Stdout)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	default:
+		log.Fatalf("unknown command %q", flag.Arg(0))
+	}
+
 	exporter := newApp()
+	exporter.forceRefresh = forceRefresh
+	if exporter.MetricsAddress != "" {
+		exporter.startMetricsServer()
+	}
+
 	exporter.lockState()
-	defer exporter.unlockState()
-	exporter.cleanupTempFiles()
-	exporter.updateFileList()
-	exporter.updateFromKubecost()
-	exporter.uploadToFlexera()
+
+	var err error
+	switch {
+	case !backfillRange.isEmpty():
+		err = exporter.backfill(backfillRange)
+	case *daemon:
+		exporter.runDaemon()
+	default:
+		err = exporter.runOnce()
+	}
+
+	// log.Fatal does not run the deferred functions, the lock is released first
+	exporter.unlockState()
+	if err != nil {
+		//the below method internally uses os.Exit(1)
+		log.Fatal(err)
+	}
 }
 
-func (a *App) updateFromKubecost() {
+// runOnce runs the export and upload cycle of the one-shot mode.
+func (a *App) runOnce() error {
+	a.cleanupTempFiles()
+	if err := a.updateFileList(); err != nil {
+		return err
+	}
+	if err := a.updateFromKubecost(); err != nil {
+		return err
+	}
+	return a.upload()
+}
+
+func (a *App) updateFromKubecost() error {
+	start := time.Now()
+	defer func() {
+		cycleDuration.WithLabelValues("export").Observe(time.Since(start).Seconds())
+	}()
+
 	now := time.Now().Local()
 	now = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
 
-	err := os.MkdirAll(a.FilePath, os.ModePerm)
-	if err != nil {
-		log.Fatal(err)
+	a.filesMutex.Lock()
+	a.unreconciledMonths = make(map[string]struct{})
+	a.filesMutex.Unlock()
+
+	a.cloudCostsMutex.Lock()
+	a.cloudCostRequests = make(map[string]*cloudCostsRequest)
+	a.cloudCostsMutex.Unlock()
+
+	if err := os.MkdirAll(a.FilePath, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", a.FilePath, err)
 	}
 
-	currency := a.getCurrency()
+	type exportJob struct {
+		endpoint KubecostEndpoint
+		currency string
+		date     time.Time
+	}
 
-	for d := range dateIter(now.AddDate(0, -(len(a.invoiceMonths)), 0)) {
+	// Each worker processes one date of one endpoint at a time with its own FileWriter
+	jobs := make(chan exportJob)
+	var wg sync.WaitGroup
+	for i := 0; i < a.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				err := a.processDateWithStreaming(job.endpoint, job.date, job.currency)
+				if err != nil {
+					log.Printf("Error processing date %s of %s: %v", job.date.Format("2006-01-02"), job.endpoint.label(), err)
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for _, endpoint := range a.endpoints {
+		currency := a.getCurrency(endpoint)
+		for _, d := range a.datesToExport(endpoint, now) {
+			// Let the dates in progress drain, but do not start a new one once a shutdown was requested
+			if a.ctx.Err() != nil {
+				log.Printf("Shutdown requested, stopping Kubecost export before date %s of %s", d.Format("2006-01-02"), endpoint.label())
+				break dispatch
+			}
+			jobs <- exportJob{endpoint: endpoint, currency: currency, date: d}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return nil
+}
+
+// datesToExport returns the dates of the invoice months up to now that must be requested from the endpoint.
+// Days older than SettledAfterDays that already have a finalized file for the endpoint are skipped, since
+// Kubecost no longer changes them, unless they are within the force refresh range.
+func (a *App) datesToExport(endpoint KubecostEndpoint, now time.Time) []time.Time {
+	// The workers of the previous endpoint may still be finalizing files
+	a.filesMutex.Lock()
+	exportedDays := make(map[string]struct{})
+	for _, files := range a.filesToUpload {
+		for fileName := range files {
+			if name, date, ok := parseFileName(fileName); ok && name == endpoint.Name {
+				exportedDays[date] = struct{}{}
+			}
+		}
+	}
+	a.filesMutex.Unlock()
+
+	var dates []time.Time
+	settledDays := 0
+	for d := range dateIter(a.firstInvoiceDay()) {
 		if d.After(now) || !a.dateInInvoiceRange(d) {
 			continue
 		}
 
-		err := a.processDateWithStreaming(d, currency)
-		if err != nil {
-			log.Printf("Error processing date %s: %v", d.Format("2006-01-02"), err)
+		_, exported := exportedDays[d.Format("2006-01-02")]
+		if exported && a.isSettledDay(d, now) && !a.forceRefresh.contains(d) {
+			settledDays++
 			continue
 		}
+
+		dates = append(dates, d)
+	}
+
+	if settledDays > 0 {
+		log.Printf("Skipping %d days of %s older than %d days that already have files", settledDays, endpoint.label(), a.SettledAfterDays)
 	}
+
+	return dates
 }
-func (a *App) processDateWithStreaming(d time.Time, currency string) error {
-	tomorrow := d.AddDate(0, 0, 1)
+
+// firstInvoiceDay returns the first day of the earliest invoice month.
+func (a *App) firstInvoiceDay() time.Time {
+	var first time.Time
+	for _, month := range a.invoiceMonths {
+		date, err := time.ParseInLocation("2006-01", month, time.Local)
+		if err == nil && (first.IsZero() || date.Before(first)) {
+			first = date
+		}
+	}
+	return first
+}
+
+func (a *App) isSettledDay(d, now time.Time) bool {
+	return a.SettledAfterDays > 0 && d.Before(now.AddDate(0, 0, -a.SettledAfterDays))
+}
+
+func (a *App) processDateWithStreaming(endpoint KubecostEndpoint, d time.Time, currency string) error {
 	currentDate := d.Format("2006-01-02")
 	monthOfData := d.Format("2006-01")
 
-	fileWriter, err := newFileWriter(a, fmt.Sprintf(path.Join(a.FilePath, "kubecost-%v.csv.gz"), currentDate))
+	conversion, err := a.currencyConversion(currency, d)
+	if err != nil {
+		return fmt.Errorf("failed to convert costs of %s, keeping existing files: %v", currentDate, err)
+	}
+
+	fileWriter, err := newFileWriter(a, path.Join(a.FilePath, endpoint.fileName(currentDate, a.fileExtension())))
 	if err != nil {
 		return fmt.Errorf("failed to create file writer: %v", err)
 	}
-	defer func() {
-		if err := fileWriter.close(); err != nil {
-			log.Printf("Warning: failed to close file writer: %v", err)
-		}
-	}()
+	// Unless the day is finalized, the temp files are removed and any existing file for the day is kept
+	defer fileWriter.discard()
 
 	err = fileWriter.writeHeaders(a.getCSVHeaders())
 	if err != nil {
 		return fmt.Errorf("failed to write headers: %v", err)
 	}
 
+	source := a.allocationSource(endpoint)
 	page := 0
-	limit := a.PageSize
 	requestNewPage := true
 	totalRecordsProcessed := 0
 	totalRowsProcessed := 0
 	idleRecords := make(map[string]KubecostAllocation)
+	exportedCosts := costTotals{}
 
-	log.Printf("Starting streaming processing for date %s", currentDate)
-
-	// https://github.com/kubecost/docs/blob/master/allocation.md#querying
-	baseURL := fmt.Sprintf("http://%s", a.KubecostHost)
-	reqURL, err := url.JoinPath(baseURL, a.KubecostAPIPath, "allocation")
-	if err != nil {
-		return fmt.Errorf("failed to build allocation URL: %w", err)
-	}
+	log.Printf("Starting streaming processing for date %s of %s", currentDate, endpoint.label())
 
 	for requestNewPage {
-		req, err := http.NewRequest("GET", reqURL, nil)
+		reqURL, err := source.allocationURL(endpoint, d, page)
 		if err != nil {
-			return fmt.Errorf("failed to create request: %v", err)
+			return fmt.Errorf("failed to build allocation URL: %w", err)
 		}
 
-		q := req.URL.Query()
-		q.Add("window", fmt.Sprintf("%s,%s", d.Format("2006-01-02T15:04:05Z"), tomorrow.Format("2006-01-02T15:04:05Z")))
-		q.Add("aggregate", a.aggregation)
-		q.Add("idle", fmt.Sprintf("%t", a.Idle))
-		q.Add("includeIdle", fmt.Sprintf("%t", a.Idle))
-		q.Add("idleByNode", fmt.Sprintf("%t", a.IdleByNode))
-		q.Add("shareIdle", fmt.Sprintf("%t", a.ShareIdle))
-		q.Add("shareNamespaces", a.ShareNamespaces)
-		q.Add("shareSplit", "weighted")
-		q.Add("shareTenancyCosts", fmt.Sprintf("%t", a.ShareTenancyCosts))
-		q.Add("step", "1d")
-		q.Add("accumulate", "true")
-		q.Add("offset", fmt.Sprintf("%d", page*limit))
-		q.Add("limit", fmt.Sprintf("%d", limit))
-
-		req.URL.RawQuery = q.Encode()
-		log.Printf("Request: %s?%s", reqURL, q.Encode())
-
-		resp, err := a.client.Do(req)
+		j, err := a.getAllocationPage(endpoint, source, reqURL)
 		if err != nil {
-			return fmt.Errorf("failed to make request: %v", err)
-		}
-		defer resp.Body.Close()
-
-		var j KubecostAllocationResponse
-		if err = json.NewDecoder(resp.Body).Decode(&j); err != nil {
-			return fmt.Errorf("failed to decode response: %v", err)
-		}
-
-		if j.Code != http.StatusOK {
-			log.Printf("Kubecost API response code %d, skipping page %d", j.Code, page)
-			break
+			return fmt.Errorf("stream ended abnormally on page %d, keeping existing files: %v", page, err)
 		}
+		requestNewPage = !source.lastPage(j)
 
 		pageRecordsProcessed := 0
-
-		for k, allocation := range j.Data {
-			if page == 0 && k == 0 && len(allocation) > 0 {
-				log.Printf("Kubecost returned data for %s, cleaning up old indexed files", currentDate)
-				a.cleanupOldFiles(monthOfData, currentDate)
+		for _, allocation := range j.Data {
+			// The rows are written in a stable order, so unchanged data gives byte-identical files
+			ids := make([]string, 0, len(allocation))
+			for id := range allocation {
+				ids = append(ids, id)
 			}
+			sort.Strings(ids)
 
-			for id, record := range allocation {
+			for _, id := range ids {
+				record := allocation[id]
 				if a.isIdleRecord(record) {
-					idleRecords[id] = record
+					// Idle records are repeated on every page, and in every hourly set with the same id
+					idleRecords[record.Window.Start+"/"+id] = record
 				} else {
-					rows := a.getCSVRowsFromRecord(currency, monthOfData, record)
+					rows := a.getCSVRowsFromRecord(conversion, monthOfData, record)
 					for _, row := range rows {
-						err := fileWriter.writeRow(row, monthOfData, a.filesToUpload)
+						err := fileWriter.writeRow(row)
 						if err != nil {
 							return err
 						}
 						totalRowsProcessed++
 					}
 					pageRecordsProcessed++
+					exportedCosts.add(a, record)
 				}
 			}
-			totalRecords := len(allocation)
-			if a.ShareIdle && totalRecords < a.PageSize || !a.ShareIdle && totalRecords < a.PageSize+1 {
-				requestNewPage = false
-			}
 		}
 
 		totalRecordsProcessed += pageRecordsProcessed
@@ -302,50 +491,181 @@ func (a *App) processDateWithStreaming(d time.Time, currency string) error {
 		page++
 	}
 
-	for _, record := range idleRecords {
-		rows := a.getCSVRowsFromRecord(currency, monthOfData, record)
+	idleKeys := make([]string, 0, len(idleRecords))
+	for key := range idleRecords {
+		idleKeys = append(idleKeys, key)
+	}
+	sort.Strings(idleKeys)
+
+	for _, key := range idleKeys {
+		record := idleRecords[key]
+		rows := a.getCSVRowsFromRecord(conversion, monthOfData, record)
 		for _, row := range rows {
-			err := fileWriter.writeRow(row, monthOfData, a.filesToUpload)
+			err := fileWriter.writeRow(row)
 			if err != nil {
 				return err
 			}
 			totalRowsProcessed++
 		}
+		exportedCosts.add(a, record)
 	}
 	totalRecordsProcessed += len(idleRecords)
 	log.Printf("Processed %d idle records", len(idleRecords))
 
+	if a.Reconcile {
+		if err := a.reconcile(endpoint, source, d, exportedCosts); err != nil {
+			a.markUnreconciled(monthOfData)
+			reconciliationFailures.Inc()
+			return fmt.Errorf("reconciliation of %s failed, keeping existing files and skipping the upload of %s: %v", currentDate, monthOfData, err)
+		}
+		log.Printf("Reconciled costs of %s of %s with the cluster totals", currentDate, endpoint.label())
+	}
+
+	if a.ExportAssets {
+		assetRows, err := a.writeAssetRows(endpoint, d, conversion, fileWriter)
+		if err != nil {
+			return fmt.Errorf("failed to export assets, keeping existing files: %v", err)
+		}
+		totalRecordsProcessed += assetRows
+		totalRowsProcessed += assetRows
+	}
+
+	if a.ExportCloudCosts {
+		cloudCostRows, err := a.writeCloudCostRows(endpoint, d, conversion, fileWriter)
+		if err != nil {
+			return fmt.Errorf("failed to export cloud costs, keeping existing files: %v", err)
+		}
+		totalRecordsProcessed += cloudCostRows
+		totalRowsProcessed += cloudCostRows
+	}
+
 	// If the data obtained is empty, skip the iteration, because it might overwrite a previously obtained file for the same range time
 	if totalRecordsProcessed == 0 {
 		log.Printf("No data for date %s, removing empty file", currentDate)
 		return nil
 	}
 
+	// The stream completed, so the new files replace the ones generated by previous runs under the same names.
+	// The files of previous runs are only removed once the new files are flushed and renamed, so a failure to
+	// finalize them keeps the existing day
 	err = fileWriter.finalizeFile(monthOfData, a.filesToUpload)
 	if err != nil {
-		return fmt.Errorf("failed to finalize file: %v", err)
+		return fmt.Errorf("failed to finalize file, keeping existing files: %v", err)
 	}
+	a.cleanupOldFiles(endpoint, monthOfData, currentDate, fileWriter.files)
 
-	if err := validateGzipHeaders(fileWriter.filePath); err != nil {
-		log.Printf("Warning: file failed validation: %v", err)
+	if a.OutputFormat == outputFormatCSV {
+		if err := validateGzipHeaders(fileWriter.filePath); err != nil {
+			log.Printf("Warning: file failed validation: %v", err)
+		}
 	}
 
-	log.Printf("Completed processing for %s: %d total records, %d data rows", currentDate, totalRecordsProcessed, totalRowsProcessed)
+	log.Printf("Completed processing for %s of %s: %d total records, %d data rows", currentDate, endpoint.label(), totalRecordsProcessed, totalRowsProcessed)
 	return nil
 }
 
-func (a *App) cleanupOldFiles(monthOfData, currentDate string) {
+// getAllocationPage requests a page of the Kubecost Allocation API, retrying network errors, HTTP errors,
+// undecodable responses and error codes in the response body up to RetryMaxAttempts attempts.
+// Client errors are not retried.
+func (a *App) getAllocationPage(endpoint KubecostEndpoint, source allocationSource, reqURL string) (*KubecostAllocationResponse, error) {
+	var j *KubecostAllocationResponse
+
+	err := a.retryKubecost(reqURL, func() (retryable bool, err error) {
+		pageStart := time.Now()
+		retryable, err = a.requestKubecost(endpoint, reqURL, func(r io.Reader) (int64, string, error) {
+			j, err = source.decodeAllocations(r)
+			if err != nil {
+				return 0, "", err
+			}
+			return j.Code, j.Message, nil
+		})
+		if err == nil {
+			kubecostPageDuration.Observe(time.Since(pageStart).Seconds())
+			kubecostPagesFetched.Inc()
+		}
+		return retryable, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// retryKubecost runs attempt until it succeeds, fails with an error that is not retryable, or
+// RetryMaxAttempts attempts were made.
+func (a *App) retryKubecost(reqURL string, attempt func() (retryable bool, err error)) error {
+	maxAttempts := max(a.RetryMaxAttempts, 1)
+
+	for i := 1; ; i++ {
+		log.Printf("Request (attempt %d/%d): %s", i, maxAttempts, reqURL)
+
+		retryable, err := attempt()
+		if err == nil {
+			return nil
+		}
+
+		if !retryable || i >= maxAttempts {
+			return fmt.Errorf("%v (after %d attempts)", err, i)
+		}
+
+		delay := a.retryDelay(i, nil)
+		log.Printf("Kubecost request failed (attempt %d/%d): %v, retrying in %s", i, maxAttempts, err, delay)
+		if ctxErr := a.sleep(delay); ctxErr != nil {
+			return fmt.Errorf("%v (cancelled after %d attempts: %v)", err, i, ctxErr)
+		}
+	}
+}
+
+// requestKubecost sends a GET request to the endpoint and decodes the response body with decode,
+// which returns the code and message reported in the body.
+func (a *App) requestKubecost(endpoint KubecostEndpoint, reqURL string, decode func(io.Reader) (int64, string, error)) (retryable bool, err error) {
+	request, err := endpoint.newRequest(reqURL)
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	resp, err := a.kubecostClient(endpoint).Do(request)
+	if err != nil {
+		return true, fmt.Errorf("failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return isRetryableStatus(resp.StatusCode), fmt.Errorf("unexpected HTTP status %d", resp.StatusCode)
+	}
+
+	code, message, err := decode(resp.Body)
+	if err != nil {
+		return true, fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	if code != http.StatusOK {
+		return isRetryableStatus(int(code)), fmt.Errorf("kubecost API response code %d: %s", code, message)
+	}
+
+	return false, nil
+}
+
+func (a *App) cleanupOldFiles(endpoint KubecostEndpoint, monthOfData, currentDate string, newFiles []string) {
+	a.filesMutex.Lock()
+	defer a.filesMutex.Unlock()
+
 	filesToRemove := make([]string, 0)
 
-	// Find all indexed files for this date (kubecost-date-2.csv.gz, kubecost-date-3.csv.gz, etc.)
+	// Find all indexed files of the endpoint for this date (kubecost-date-2.csv.gz, kubecost-date-3.csv.gz, etc.)
+	// that were not replaced by the new files, the files of the other endpoints are left untouched
 	for filename := range a.filesToUpload[monthOfData] {
-		if strings.Contains(filename, currentDate) && !strings.HasSuffix(filename, ".tmp") {
+		if slices.Contains(newFiles, filename) {
+			continue
+		}
+		if name, date, ok := parseFileName(filename); ok && name == endpoint.Name && date == currentDate {
 			filesToRemove = append(filesToRemove, filename)
 		}
 	}
 
 	if len(filesToRemove) > 0 {
-		log.Printf("Kubecost has data for %s, removing %d old indexed files", currentDate, len(filesToRemove))
+		log.Printf("Kubecost %s has data for %s, removing %d old indexed files", endpoint.label(), currentDate, len(filesToRemove))
 
 		for _, filename := range filesToRemove {
 			err := os.Remove(filename)
@@ -362,135 +682,110 @@ func (a *App) isIdleRecord(record KubecostAllocation) bool {
 	return strings.Contains(record.Name, "_idle_")
 }
 
-func (a *App) uploadToFlexera() {
-	accessToken, err := a.generateAccessToken()
-	if err != nil {
-		log.Fatalf("Error generating access token: %v", err)
+// isMonthComplete reports whether the files of a month can be uploaded. The current month is always
+// uploaded, but for previous months we need to check if every endpoint has files for all days in the month.
+func (a *App) isMonthComplete(month string, files map[string]struct{}) bool {
+	if a.isCurrentMonth(month) {
+		return true
 	}
 
-	authHeaders := map[string]string{"Authorization": "Bearer " + accessToken}
-
-	atLeastOneError := false
-
-	for month, files := range a.filesToUpload {
-
-		if len(files) == 0 {
-			log.Println("No files to upload for month", month)
-			continue
-		}
-
-		// if we try to upload files for previous month, we need to check if we have files for all days in the month
-		if !a.isCurrentMonth(month) {
-			// Since there may be more than one file for the same day, we must ensure that there is at least one file for each day.
-			daysToUpload := map[string]struct{}{}
-			for filename := range files {
-				matches := fileNameRe.FindStringSubmatch(filename)
-				if len(matches) >= 2 {
-					daysToUpload[matches[1]] = struct{}{}
-				}
-			}
-
-			if a.DaysInMonth(month) > len(daysToUpload) {
-				log.Println("Skipping month", month, "because not all days have a file to upload")
-				continue
-			}
-		}
-
-		billUploadID, err := a.StartBillUploadProcess(month, authHeaders)
-		if err != nil {
-			log.Println(err)
-			atLeastOneError = true
-			continue
-		}
-
-		for fileName := range files {
-			err = a.UploadFile(billUploadID, fileName, authHeaders)
-			if err != nil {
-				log.Printf("Error uploading file: %s. %s\n", fileName, err.Error())
-				atLeastOneError = true
-				break
+	// Since there may be more than one file for the same day, we must ensure that there is at least one file for each day.
+	daysToUpload := map[string]map[string]struct{}{}
+	for filename := range files {
+		if name, date, ok := parseFileName(filename); ok {
+			if daysToUpload[name] == nil {
+				daysToUpload[name] = map[string]struct{}{}
 			}
+			daysToUpload[name][date] = struct{}{}
 		}
+	}
 
-		if err != nil {
-			err = a.AbortBillUploadProcess(billUploadID, authHeaders)
-		} else {
-			err = a.CommitBillUploadProcess(billUploadID, authHeaders)
-		}
-		if err != nil {
-			log.Println(err)
-			atLeastOneError = true
+	for _, endpoint := range a.endpoints {
+		if a.DaysInMonth(month) > len(daysToUpload[endpoint.Name]) {
+			return false
 		}
 	}
 
-	//If at least one error in bill processing exit with code 1
-	if atLeastOneError {
-		//the below method internally uses os.Exit(1)
-		log.Fatal("Error during bill upload. Internal server error")
-	}
+	return true
 }
 
 func (a *App) StartBillUploadProcess(month string, authHeaders map[string]string) (billUploadID string, err error) {
 	//Before the upload process create bill connect
-	a.createBillConnectIfNotExist(authHeaders)
+	if err := a.createBillConnectIfNotExist(authHeaders); err != nil {
+		return "", err
+	}
 	billUpload := map[string]string{"billConnectId": a.BillConnectID, "billingPeriod": month}
-
 	billUploadJSON, _ := json.Marshal(billUpload)
+
+	// A bill upload still in progress for the month is aborted before starting a new one, up to
+	// RetryMaxAttempts times so an upload that stays in conflict does not loop forever
+	maxAttempts := max(a.RetryMaxAttempts, 1)
+	for attempt := 1; ; attempt++ {
+		billUploadID, inProgressBillUploadID, err := a.startBillUpload(billUploadJSON, authHeaders)
+		if err != nil || inProgressBillUploadID == "" {
+			return billUploadID, err
+		}
+
+		if attempt >= maxAttempts {
+			return "", fmt.Errorf("bill upload %s of month %s is still in progress after %d attempts", inProgressBillUploadID, month, attempt)
+		}
+		log.Printf("Aborting bill upload %s in progress for month %s (attempt %d/%d)", inProgressBillUploadID, month, attempt, maxAttempts)
+		if err := a.AbortBillUploadProcess(inProgressBillUploadID, authHeaders); err != nil {
+			return "", err
+		}
+	}
+}
+
+// startBillUpload requests a new bill upload and returns its ID, or the ID of the bill upload of the
+// month already in progress when Flexera reports a conflict.
+func (a *App) startBillUpload(billUploadJSON []byte, authHeaders map[string]string) (billUploadID, inProgressBillUploadID string, err error) {
 	response, err := a.doPost(a.billUploadURL, string(billUploadJSON), authHeaders)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
+	defer response.Body.Close()
 
-	switch response.StatusCode {
-	case 429:
-		time.Sleep(120 * time.Second)
-		return a.StartBillUploadProcess(month, authHeaders)
-	case 409:
+	if response.StatusCode == http.StatusConflict {
 		bodyBytes, err := io.ReadAll(response.Body)
 		if err != nil {
-			return "", err
+			return "", "", err
 		}
 		uuidMatch := uuidPattern.FindStringSubmatch(string(bodyBytes))
 		if len(uuidMatch) < 2 {
-			return "", fmt.Errorf("billUpload ID not found")
+			return "", "", fmt.Errorf("billUpload ID not found")
 		}
-		inProgressBillUploadID := uuidMatch[1]
-		err = a.AbortBillUploadProcess(inProgressBillUploadID, authHeaders)
-		if err != nil {
-			return "", err
-		}
-		return a.StartBillUploadProcess(month, authHeaders)
+		return "", uuidMatch[1], nil
 	}
 
 	err = checkForError(response)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	bodyBytes, err := io.ReadAll(response.Body)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	var jsonResponse map[string]interface{}
 	if err = json.Unmarshal(bodyBytes, &jsonResponse); err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	return jsonResponse["id"].(string), nil
+	return jsonResponse["id"].(string), "", nil
 }
 
-func (a *App) createBillConnectIfNotExist(authHeaders map[string]string) {
+func (a *App) createBillConnectIfNotExist(authHeaders map[string]string) error {
 
 	//If the flag is not enabled, do not attempt to create the bill connect
 	if !a.CreateBillConnectIfNotExist {
-		return
+		return nil
 	}
 
 	integrationID := "cbi-oi-kubecost"
 	//Split the billConnectId using the integrationId based on the bill identifier
 	if !strings.HasPrefix(a.BillConnectID, integrationID) {
-		log.Fatal("billConnectId does not start with the required prefix")
+		return fmt.Errorf("billConnectId does not start with the required prefix")
 	}
 	billIdentifier := strings.TrimPrefix(a.BillConnectID, integrationID+"-")
 	//Vendor name is same as display name
@@ -503,9 +798,10 @@ func (a *App) createBillConnectIfNotExist(authHeaders map[string]string) {
 	billConnectJSON, _ := json.Marshal(createBillConnectPayload)
 	response, err := a.doPost(url, string(billConnectJSON), authHeaders)
 	if err != nil {
-		//When the bill connect id is not provided, abort the process
-		log.Fatalf("Error while creating the bill connect : %v", err)
+		//When the bill connect id is not provided, abort the upload
+		return fmt.Errorf("error while creating the bill connect: %v", err)
 	}
+	defer response.Body.Close()
 
 	switch response.StatusCode {
 	case 201:
@@ -513,8 +809,10 @@ func (a *App) createBillConnectIfNotExist(authHeaders map[string]string) {
 	case 409:
 		log.Printf("Bill Connect Id already exists %s", a.BillConnectID)
 	default:
-		log.Fatalf("Error while creating the bill connect : %v", err)
+		return fmt.Errorf("error while creating the bill connect: status code %d", response.StatusCode)
 	}
+
+	return nil
 }
 
 func (a *App) CommitBillUploadProcess(billUploadID string, headers map[string]string) error {
@@ -525,7 +823,12 @@ func (a *App) CommitBillUploadProcess(billUploadID string, headers map[string]st
 	}
 	log.Println("commit upload bill process with id", billUploadID)
 
-	return checkForError(response)
+	if err = checkForError(response); err != nil {
+		return err
+	}
+
+	billUploadOperations.WithLabelValues("commit").Inc()
+	return nil
 }
 
 func (a *App) AbortBillUploadProcess(billUploadID string, headers map[string]string) error {
@@ -536,7 +839,12 @@ func (a *App) AbortBillUploadProcess(billUploadID string, headers map[string]str
 	}
 	log.Println("aborting upload bill process with id", billUploadID)
 
-	return checkForError(response)
+	if err = checkForError(response); err != nil {
+		return err
+	}
+
+	billUploadOperations.WithLabelValues("abort").Inc()
+	return nil
 }
 
 func (a *App) UploadFile(billUploadID, fileName string, authHeaders map[string]string) error {
@@ -569,8 +877,11 @@ func (a *App) UploadFile(billUploadID, fileName string, authHeaders map[string]s
 		return fmt.Errorf("error parsing response: %s", err.Error())
 	}
 
+	uploadedBytes.Add(float64(len(fileData)))
+
 	md5Hash := getMD5FromFileBytes(fileData)
 	if md5Hash != uploadResponse.MD5 {
+		md5Mismatches.Inc()
 		return fmt.Errorf("MD5 of file %s does not match MD5 of uploaded file", fileName)
 	}
 
@@ -579,14 +890,17 @@ func (a *App) UploadFile(billUploadID, fileName string, authHeaders map[string]s
 }
 
 func (a *App) doPost(url, data string, headers map[string]string) (*http.Response, error) {
-	request, _ := http.NewRequest("POST", url, strings.NewReader(data))
-	log.Printf("Request: %+v\n", url)
-
-	for key, value := range headers {
-		request.Header.Set(key, value)
-	}
+	response, err := a.doWithRetry(func() (*http.Request, error) {
+		request, err := http.NewRequest("POST", url, strings.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
 
-	response, err := a.client.Do(request)
+		for key, value := range headers {
+			request.Header.Set(key, value)
+		}
+		return request, nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -608,14 +922,15 @@ func (a *App) generateAccessToken() (string, error) {
 		reqBody.Set("client_secret", a.ServiceClientSecret)
 	}
 
-	req, err := http.NewRequest("POST", accessTokenURL, strings.NewReader(reqBody.Encode()))
-	if err != nil {
-		return "", fmt.Errorf("error creating access token request: %v", err)
-	}
-
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := a.doWithRetry(func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", accessTokenURL, strings.NewReader(reqBody.Encode()))
+		if err != nil {
+			return nil, fmt.Errorf("error creating access token request: %v", err)
+		}
 
-	resp, err := a.client.Do(req)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	})
 	if err != nil {
 		return "", fmt.Errorf("error retrieving access token: %v", err)
 	}
@@ -643,19 +958,34 @@ func (a *App) generateAccessToken() (string, error) {
 }
 
 // update file list and remove old files
-func (a *App) updateFileList() {
+func (a *App) updateFileList() error {
 	files, err := os.ReadDir(a.FilePath)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("failed to list files of %s: %v", a.FilePath, err)
+	}
+
+	endpoints := make(map[string]struct{}, len(a.endpoints))
+	for _, endpoint := range a.endpoints {
+		endpoints[endpoint.Name] = struct{}{}
 	}
 
 	for _, file := range files {
 		if file.Type().IsRegular() {
-			matches := fileNameRe.FindStringSubmatch(file.Name())
-			if matches != nil {
-				if t, err := time.Parse("2006-01-02", matches[1]); err == nil {
-					if a.dateInInvoiceRange(t) {
+			// The manifests are rotated with the files of their month
+			if t, ok := parseManifestFileName(file.Name()); ok && a.FileRotation && !a.dateInMandatoryFileSavingPeriod(t) {
+				if err = os.Remove(path.Join(a.FilePath, file.Name())); err != nil {
+					log.Printf("error removing file %s: %v", file.Name(), err)
+				}
+			}
+			if name, date, ok := parseFileName(file.Name()); ok {
+				if t, err := time.Parse("2006-01-02", date); err == nil {
+					_, configured := endpoints[name]
+					if a.dateInInvoiceRange(t) && configured {
 						a.filesToUpload[t.Format("2006-01")][path.Join(a.FilePath, file.Name())] = struct{}{}
+					} else if a.dateInInvoiceRange(t) {
+						// The files of a removed or renamed endpoint are no longer refreshed, uploading them
+						// with the files of the configured endpoints would count their costs twice
+						log.Printf("Ignoring file %s, its endpoint is not configured", file.Name())
 					} else if a.FileRotation && !a.dateInMandatoryFileSavingPeriod(t) {
 						if err = os.Remove(path.Join(a.FilePath, file.Name())); err != nil {
 							log.Printf("error removing file %s: %v", file.Name(), err)
@@ -665,17 +995,29 @@ func (a *App) updateFileList() {
 			}
 		}
 	}
+
+	return nil
 }
 
-func (a *App) getCurrency() string {
-	baseURL := fmt.Sprintf("http://%s", a.KubecostConfigHost)
-	reqURL, err := url.JoinPath(baseURL, a.KubecostConfigAPIPath, "getConfigs")
+func (a *App) getCurrency(endpoint KubecostEndpoint) string {
+	// OpenCost has no configuration API to read the currency from
+	if endpoint.Source == sourceOpenCost {
+		return a.DefaultCurrency
+	}
+
+	reqURL, err := endpoint.url(endpoint.ConfigHost, endpoint.ConfigAPIPath, "getConfigs")
 	if err != nil {
 		log.Printf("Failed to build config URL, taking default value '%s'. Error: %v", a.DefaultCurrency, err)
 		return a.DefaultCurrency
 	}
 
-	resp, err := a.client.Get(reqURL)
+	request, err := endpoint.newRequest(reqURL)
+	if err != nil {
+		log.Printf("Failed to create config request, taking default value '%s'. Error: %v", a.DefaultCurrency, err)
+		return a.DefaultCurrency
+	}
+
+	resp, err := a.kubecostClient(endpoint).Do(request)
 	log.Printf("Request: %+v\n", reqURL)
 	if err != nil {
 		log.Printf("Something went wrong, taking default value '%s'. \n Error: %s.\n", a.DefaultCurrency, err.Error())
@@ -780,17 +1122,127 @@ func (a *App) validateAppConfiguration() error {
 		a.KubecostConfigAPIPath = a.KubecostAPIPath
 	}
 
+	endpoints, err := a.resolveEndpoints()
+	if err != nil {
+		return err
+	}
+	a.endpoints = endpoints
+
+	if err := a.validateLabelRules(); err != nil {
+		return err
+	}
+
+	derivedLabels, err := a.resolveDerivedLabels()
+	if err != nil {
+		return err
+	}
+	a.derivedLabels = derivedLabels
+
+	multiplierRules, err := a.resolveMultiplierRules()
+	if err != nil {
+		return err
+	}
+	a.multiplierRules = multiplierRules
+
+	if err := a.validateCurrencyConversion(); err != nil {
+		return err
+	}
+
+	switch a.OutputFormat {
+	case outputFormatCSV:
+	case outputFormatParquet:
+		if _, err := newParquetRowType(a.getCSVHeaders()); err != nil {
+			return err
+		}
+		// Flexera only accepts CSV files, the upload would silently stop
+		if slices.Contains(a.Sinks, sinkFlexera) {
+			return fmt.Errorf("output format: parquet files cannot be uploaded to Flexera, set SINKS to s3 or directory")
+		}
+	default:
+		return fmt.Errorf("output format: %s is wrong", a.OutputFormat)
+	}
+
+	if a.ReconcileTolerance < 0 {
+		return fmt.Errorf("reconcile tolerance: %v must not be negative", a.ReconcileTolerance)
+	}
+
+	if err := a.resolveSinks(); err != nil {
+		return err
+	}
+
+	if err := a.validateColumns(); err != nil {
+		return err
+	}
+
+	if a.Resolution != resolutionDaily && a.Resolution != resolutionHourly {
+		return fmt.Errorf("resolution: %s is wrong", a.Resolution)
+	}
+	// Assets and cloud costs are daily, their rows would not match the hourly allocation rows
+	if a.Resolution == resolutionHourly && (a.ExportAssets || a.ExportCloudCosts) {
+		return fmt.Errorf("resolution: %s is not supported with EXPORT_ASSETS or EXPORT_CLOUD_COSTS", a.Resolution)
+	}
+
+	// OpenCost has no equivalent of the Kubecost Assets and Cloud Cost APIs
+	for _, endpoint := range a.endpoints {
+		if endpoint.Source != sourceOpenCost {
+			continue
+		}
+		if a.ExportAssets {
+			return fmt.Errorf("export assets: %s is not supported with OpenCost", endpoint.label())
+		}
+		// The externalCost rows would be dropped without the cloud costs replacing them
+		if a.ExportCloudCosts {
+			return fmt.Errorf("export cloud costs: %s is not supported with OpenCost", endpoint.label())
+		}
+	}
+
+	if a.ExportCloudCosts && len(a.CloudCostLabels) == 0 {
+		return fmt.Errorf("cloud cost labels: at least one label is required to export cloud costs")
+	}
+
+	if !slices.Contains(cloudCostMetrics, a.CloudCostMetric) {
+		return fmt.Errorf("cloud cost metric: %s is wrong", a.CloudCostMetric)
+	}
+
+	if a.SettledAfterDays < 0 {
+		return fmt.Errorf("settled after days: %d must not be negative", a.SettledAfterDays)
+	}
+
+	if a.Concurrency < 1 {
+		return fmt.Errorf("concurrency: %d must be at least 1", a.Concurrency)
+	}
+
+	if a.RetryMaxAttempts < 1 {
+		return fmt.Errorf("retry max attempts: %d must be at least 1", a.RetryMaxAttempts)
+	}
+
+	schedule, err := cron.ParseStandard(a.Schedule)
+	if err != nil {
+		return fmt.Errorf("schedule: %s is wrong: %v", a.Schedule, err)
+	}
+	a.schedule = schedule
+
 	return nil
 }
 
-func newApp() *App {
-	lastInvoiceDate := time.Now().Local().AddDate(0, 0, -1)
+// loadApp builds an App from the configuration, without validating it.
+func loadApp() (*App, error) {
 	a := App{
-		filesToUpload:   make(map[string]map[string]struct{}),
-		client:          &http.Client{},
-		lastInvoiceDate: lastInvoiceDate,
+		ctx:    context.Background(),
+		client: &http.Client{},
 	}
-	if err := env.Parse(&a.Config); err != nil {
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	a.Config = cfg
+
+	return &a, nil
+}
+
+func newApp() *App {
+	a, err := loadApp()
+	if err != nil {
 		log.Fatal(err)
 	}
 
@@ -800,6 +1252,16 @@ func newApp() *App {
 
 	a.client.Timeout = time.Duration(a.RequestTimeout) * time.Minute
 	a.billUploadURL = fmt.Sprintf("https://%s/optima/orgs/%s/billUploads", a.getOptimaAPIDomain(), a.OrgID)
+	a.setInvoicePeriod(time.Now().Local().AddDate(0, 0, -1))
+
+	return a
+}
+
+// setInvoicePeriod computes the invoice months and the mandatory file saving period for the given
+// last invoice date, and resets the list of files to upload for those months.
+func (a *App) setInvoicePeriod(lastInvoiceDate time.Time) {
+	a.lastInvoiceDate = lastInvoiceDate
+	a.filesToUpload = make(map[string]map[string]struct{})
 
 	a.invoiceMonths = []string{lastInvoiceDate.Format("2006-01")}
 	if a.IncludePreviousMonth {
@@ -812,41 +1274,14 @@ func newApp() *App {
 	for _, month := range a.invoiceMonths {
 		a.filesToUpload[month] = make(map[string]struct{})
 	}
-
-	return &a
 }
 
-func (a *App) getCSVHeaders() []string {
-	return []string{
-		"ResourceID",
-		"Cost",
-		"CurrencyCode",
-		"Aggregation",
-		"UsageType",
-		"UsageAmount",
-		"UsageUnit",
-		"Cluster",
-		"Container",
-		"Namespace",
-		"Pod",
-		"Node",
-		"Controller",
-		"ControllerKind",
-		"ProviderID",
-		"Labels",
-		"InvoiceYearMonth",
-		"InvoiceDate",
-		"StartTime",
-		"EndTime",
-	}
-}
-
-func (a *App) getCSVRowsFromRecord(currency string, month string, v KubecostAllocation) [][]string {
-	rows := make([][]string, 0, 8) // Pre-allocate for 8 cost types
+// allocationCostTypes are the cost types exported for each allocation, in the order of allocationCosts.
+var allocationCostTypes = []string{"cpuCost", "gpuCost", "ramCost", "pvCost", "networkCost", "sharedCost", "externalCost", "loadBalancerCost"}
 
-	labels := extractLabels(v.Properties, a.OverridePodLabels)
-	types := []string{"cpuCost", "gpuCost", "ramCost", "pvCost", "networkCost", "sharedCost", "externalCost", "loadBalancerCost"}
-	vals := []float64{
+// allocationCosts returns the costs of an allocation, adjustments included, in the order of allocationCostTypes.
+func allocationCosts(v KubecostAllocation) []float64 {
+	return []float64{
 		v.CPUCost + v.CPUCostAdjustment,
 		v.GPUCost + v.GPUCostAdjustment,
 		v.RAMCost + v.RAMCostAdjustment,
@@ -856,6 +1291,19 @@ func (a *App) getCSVRowsFromRecord(currency string, month string, v KubecostAllo
 		v.ExternalCost,
 		v.LoadBalancerCost + v.LoadBalancerCostAdjustment,
 	}
+}
+
+func (a *App) getCSVRowsFromRecord(conversion currencyConversion, month string, v KubecostAllocation) [][]string {
+	rows := make([][]string, 0, 8) // Pre-allocate for 8 cost types
+
+	derivedLabels := a.deriveLabels(v.Properties)
+	mapLabels := a.labelRules.apply(mergeLabels(v.Properties, a.OverridePodLabels))
+	// The derived labels are configured explicitly, so they are not subject to the label rules
+	for k, value := range derivedLabels {
+		mapLabels[k] = value
+	}
+	labels := labelsToJSON(mapLabels)
+	vals := allocationCosts(v)
 	units := []string{"cpuCoreHours", "gpuHours", "ramByteHours", "pvByteHours", "networkTransferBytes", "minutes", "minutes", "minutes"}
 	amounts := []float64{v.CPUCoreHours, v.GPUHours, v.RAMByteHours, v.PVByteHours, v.NetworkTransferBytes, v.Minutes, v.Minutes, v.Minutes}
 
@@ -863,13 +1311,19 @@ func (a *App) getCSVRowsFromRecord(currency string, month string, v KubecostAllo
 		v.Properties.Cluster = "Cluster"
 	}
 
-	for i, c := range types {
-		multiplierFloat := a.Multiplier * vals[i]
+	for i, c := range allocationCostTypes {
+		// The external costs are exported as itemized cloud cost rows instead
+		if c == "externalCost" && a.ExportCloudCosts {
+			continue
+		}
+
+		multiplier, multiplierRule := a.multiplier(v.Properties.Cluster, v.Properties.Namespace, c, mapLabels)
+		cost, currencyCode, original := conversion.values(multiplier * vals[i])
 
-		rows = append(rows, []string{
+		row := a.formatRow(append([]string{
 			v.Name,
-			strconv.FormatFloat(multiplierFloat, 'f', 5, 64),
-			currency,
+			cost,
+			currencyCode,
 			a.Aggregation,
 			c,
 			strconv.FormatFloat(amounts[i], 'f', 5, 64),
@@ -887,7 +1341,12 @@ func (a *App) getCSVRowsFromRecord(currency string, month string, v KubecostAllo
 			v.Window.Start,
 			v.Start,
 			v.End,
-		})
+			"",
+			"",
+			multiplierRule,
+		}, original...), mapLabels)
+
+		rows = append(rows, row)
 	}
 
 	return rows
@@ -995,9 +1454,9 @@ func dateIter(startDate time.Time) <-chan time.Time {
 	return c
 }
 
-// extractLabels returns a JSON string with all the properties labels, merging labels and namespace labels
-// and adding labels for the container, controller, pod and provider.
-func extractLabels(properties Properties, overridePodLabels bool) string {
+// mergeLabels returns all the properties labels, merging labels and namespace labels and adding labels
+// for the container, controller, pod and provider.
+func mergeLabels(properties Properties, overridePodLabels bool) map[string]string {
 	mapLabels := make(map[string]string)
 	if properties.Labels != nil {
 		mapLabels = properties.Labels
@@ -1039,8 +1498,7 @@ func extractLabels(properties Properties, overridePodLabels bool) string {
 		mapLabels["kc-namespace"] = properties.Namespace
 	}
 
-	labelsJSON, _ := json.Marshal(mapLabels)
-	return string(labelsJSON)
+	return mapLabels
 }
 
 func getMD5FromFileBytes(fileBytes []byte) string {
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type (
+	// Manifest describes the files committed to a Flexera bill upload, so the costs of a month can be
+	// reconciled against Flexera afterwards.
+	Manifest struct {
+		Month         string             `json:"month"`
+		BillUploadID  string             `json:"billUploadId"`
+		BillConnectID string             `json:"billConnectId"`
+		CommittedAt   time.Time          `json:"committedAt"`
+		Rows          int                `json:"rows"`
+		Costs         map[string]float64 `json:"costs"` // UsageType -> total cost
+		Files         []ManifestFile     `json:"files"`
+	}
+
+	ManifestFile struct {
+		FileSummary
+		Date string `json:"date"`
+		MD5  string `json:"md5"`
+	}
+)
+
+// manifestFileName returns the name of the manifest of month, written next to the files.
+func manifestFileName(month string) string {
+	return "manifest-" + month + ".json"
+}
+
+// parseManifestFileName returns the first day of the month of a manifest written by the exporter.
+func parseManifestFileName(fileName string) (time.Time, bool) {
+	month, ok := strings.CutPrefix(filepath.Base(fileName), "manifest-")
+	if !ok {
+		return time.Time{}, false
+	}
+	month, ok = strings.CutSuffix(month, ".json")
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse("2006-01", month)
+	return t, err == nil
+}
+
+// newManifest summarizes the files of a month before they are uploaded. The bill upload ID and the
+// commit time are set once the bill upload is committed.
+func (a *App) newManifest(month string, files []string) (*Manifest, error) {
+	manifest := &Manifest{
+		Month:         month,
+		BillConnectID: a.BillConnectID,
+		Costs:         make(map[string]float64),
+		Files:         make([]ManifestFile, 0, len(files)),
+	}
+
+	for _, fileName := range files {
+		summary, err := summarizeFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		md5Hash, err := getMD5FromFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		_, date, _ := parseFileName(fileName)
+
+		for usageType, cost := range summary.Costs {
+			summary.Costs[usageType] = roundCost(cost)
+			manifest.Costs[usageType] += cost
+		}
+		manifest.Rows += summary.Rows
+		manifest.Files = append(manifest.Files, ManifestFile{FileSummary: summary, Date: date, MD5: md5Hash})
+	}
+
+	for usageType, cost := range manifest.Costs {
+		manifest.Costs[usageType] = roundCost(cost)
+	}
+
+	return manifest, nil
+}
+
+// save writes the manifest atomically in dir.
+func (m *Manifest) save(dir string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %v", err)
+	}
+
+	manifestPath := filepath.Join(dir, manifestFileName(m.Month))
+	tempPath := manifestPath + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+
+	if err := os.Rename(tempPath, manifestPath); err != nil {
+		return fmt.Errorf("failed to replace manifest: %v", err)
+	}
+
+	return nil
+}
+
+// roundCost rounds a sum of costs to the 5 decimals of the exported costs.
+func roundCost(cost float64) float64 {
+	return math.Round(cost*1e5) / 1e5
+}
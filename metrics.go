@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "kubecost_exporter"
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+	metricsFactory  = promauto.With(metricsRegistry)
+
+	kubecostPagesFetched = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "kubecost_pages_fetched_total",
+		Help:      "Number of Kubecost allocation pages fetched.",
+	})
+	kubecostPageDuration = metricsFactory.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "kubecost_page_duration_seconds",
+		Help:      "Time spent requesting and decoding a Kubecost allocation page.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	})
+	rowsWritten = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rows_written_total",
+		Help:      "Number of data rows written to bill files.",
+	})
+	fileRotations = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "file_rotations_total",
+		Help:      "Number of times a bill file was rotated because it reached MAX_FILE_ROWS.",
+	})
+	uploadedBytes = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "uploaded_bytes_total",
+		Help:      "Number of bytes of bill files uploaded to Flexera.",
+	})
+	md5Mismatches = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "md5_mismatches_total",
+		Help:      "Number of uploaded files whose MD5 did not match the MD5 reported by Flexera.",
+	})
+	billUploadOperations = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "bill_upload_operations_total",
+		Help:      "Number of bill upload operations completed, by operation (commit or abort).",
+	}, []string{"operation"})
+	lastCommitTimestamp = metricsFactory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_commit_timestamp_seconds",
+		Help:      "Unix timestamp of the last successful bill upload commit, by billing month.",
+	}, []string{"month"})
+	lastUpToDateTimestamp = metricsFactory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_up_to_date_timestamp_seconds",
+		Help:      "Unix timestamp of the last time the files of a billing month were published to a sink or found identical to the ones it last received, by sink and month.",
+	}, []string{"sink", "month"})
+	reconciliationFailures = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reconciliation_failures_total",
+		Help:      "Number of days whose exported costs did not match the Kubecost cluster totals.",
+	})
+	cycleDuration = metricsFactory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "cycle_duration_seconds",
+		Help:      "Duration of the export and upload phases of each cycle.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 16),
+	}, []string{"phase"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// startMetricsServer exposes the Prometheus /metrics endpoint on MetricsAddress in the background.
+func (a *App) startMetricsServer() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	go func() {
+		log.Printf("Serving metrics on %s/metrics", a.MetricsAddress)
+		if err := http.ListenAndServe(a.MetricsAddress, mux); err != nil {
+			log.Printf("Warning: metrics server stopped: %v", err)
+		}
+	}()
+}
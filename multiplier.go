@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+type (
+	// MultiplierRule applies its multiplier, instead of the global Multiplier, to the costs of the rows
+	// it matches. Every condition that is set must match: Cluster and Namespace are regular expressions,
+	// Labels must all be present with the same value, and CostTypes lists the matching UsageType values.
+	MultiplierRule struct {
+		Name       string            `json:"name" yaml:"name"`
+		Cluster    string            `json:"cluster,omitempty" yaml:"cluster,omitempty"`
+		Namespace  string            `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+		Labels     map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+		CostTypes  []string          `json:"costTypes,omitempty" yaml:"costTypes,omitempty"`
+		Multiplier *float64          `json:"multiplier" yaml:"multiplier"`
+
+		clusterRe   *regexp.Regexp
+		namespaceRe *regexp.Regexp
+	}
+
+	MultiplierRules []MultiplierRule
+)
+
+// UnmarshalText parses the MULTIPLIER_RULES environment variable, given as a JSON array.
+func (m *MultiplierRules) UnmarshalText(text []byte) error {
+	return json.Unmarshal(text, (*[]MultiplierRule)(m))
+}
+
+// resolveMultiplierRules validates the MultiplierRules and returns them with their regular expressions compiled.
+func (a *App) resolveMultiplierRules() ([]MultiplierRule, error) {
+	names := make(map[string]struct{}, len(a.MultiplierRules))
+	rules := make([]MultiplierRule, 0, len(a.MultiplierRules))
+	for _, rule := range a.MultiplierRules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("multiplier rule: name is required")
+		}
+		if _, ok := names[rule.Name]; ok {
+			return nil, fmt.Errorf("multiplier rule: %q is defined more than once", rule.Name)
+		}
+		names[rule.Name] = struct{}{}
+
+		if rule.Multiplier == nil || *rule.Multiplier < 0 {
+			return nil, fmt.Errorf("multiplier rule %s: multiplier is required and must not be negative", rule.Name)
+		}
+
+		var err error
+		if rule.Cluster != "" {
+			if rule.clusterRe, err = regexp.Compile(rule.Cluster); err != nil {
+				return nil, fmt.Errorf("multiplier rule %s: cluster: %v", rule.Name, err)
+			}
+		}
+		if rule.Namespace != "" {
+			if rule.namespaceRe, err = regexp.Compile(rule.Namespace); err != nil {
+				return nil, fmt.Errorf("multiplier rule %s: namespace: %v", rule.Name, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func (r MultiplierRule) matches(cluster, namespace, costType string, labels map[string]string) bool {
+	if r.clusterRe != nil && !r.clusterRe.MatchString(cluster) {
+		return false
+	}
+	if r.namespaceRe != nil && !r.namespaceRe.MatchString(namespace) {
+		return false
+	}
+	if len(r.CostTypes) > 0 && !slices.Contains(r.CostTypes, costType) {
+		return false
+	}
+	for k, v := range r.Labels {
+		if value, ok := labels[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// multiplier returns the multiplier of the first rule matching the row and the name of the rule, or
+// the global Multiplier and an empty name when no rule matches.
+func (a *App) multiplier(cluster, namespace, costType string, labels map[string]string) (float64, string) {
+	for _, rule := range a.multiplierRules {
+		if rule.matches(cluster, namespace, costType, labels) {
+			return *rule.Multiplier, rule.Name
+		}
+	}
+	return a.Multiplier, ""
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+const (
+	outputFormatCSV     = "csv"
+	outputFormatParquet = "parquet"
+)
+
+type parquetColumnKind int
+
+const (
+	parquetString parquetColumnKind = iota
+	parquetDouble
+	parquetTimestamp
+	parquetLabels
+)
+
+// parquetColumnKinds are the typed built-in columns, the other columns and the label columns are strings.
+var parquetColumnKinds = map[string]parquetColumnKind{
+	"Cost":         parquetDouble,
+	"UsageAmount":  parquetDouble,
+	"OriginalCost": parquetDouble,
+	"ExchangeRate": parquetDouble,
+	"InvoiceDate":  parquetTimestamp,
+	"StartTime":    parquetTimestamp,
+	"EndTime":      parquetTimestamp,
+	"Labels":       parquetLabels,
+}
+
+// parquetRowType is the Go type of the rows of a Parquet file, built from the exported columns so the
+// file has the same columns as the CSV files, with float costs, timestamps and a map of labels.
+type parquetRowType struct {
+	typ    reflect.Type
+	kinds  []parquetColumnKind
+	schema *parquet.Schema
+}
+
+func newParquetRowType(columns []string) (*parquetRowType, error) {
+	fields := make([]reflect.StructField, 0, len(columns))
+	kinds := make([]parquetColumnKind, 0, len(columns))
+	for i, column := range columns {
+		// The column name is the name of the parquet tag, which cannot be quoted
+		if strings.ContainsAny(column, `,"`) {
+			return nil, fmt.Errorf("column: %q cannot be written to Parquet", column)
+		}
+
+		kind := parquetColumnKinds[column]
+		field := reflect.StructField{Name: fmt.Sprintf("Column%d", i)}
+		switch kind {
+		case parquetDouble:
+			field.Type = reflect.TypeOf(float64(0))
+			field.Tag = reflect.StructTag(fmt.Sprintf(`parquet:"%s"`, column))
+		case parquetTimestamp:
+			field.Type = reflect.TypeOf(time.Time{})
+			field.Tag = reflect.StructTag(fmt.Sprintf(`parquet:"%s,optional,timestamp(millisecond)"`, column))
+		case parquetLabels:
+			field.Type = reflect.TypeOf(map[string]string{})
+			field.Tag = reflect.StructTag(fmt.Sprintf(`parquet:"%s"`, column))
+		default:
+			field.Type = reflect.TypeOf("")
+			field.Tag = reflect.StructTag(fmt.Sprintf(`parquet:"%s"`, column))
+		}
+		fields = append(fields, field)
+		kinds = append(kinds, kind)
+	}
+
+	typ := reflect.StructOf(fields)
+	return &parquetRowType{
+		typ:    typ,
+		kinds:  kinds,
+		schema: parquet.SchemaOf(reflect.New(typ).Interface()),
+	}, nil
+}
+
+// value converts a row of formatted values to a pointer to a parquetRowType struct. Empty costs are
+// written as 0 and empty times as null.
+func (p *parquetRowType) value(row []string) (any, error) {
+	if len(row) != len(p.kinds) {
+		return nil, fmt.Errorf("row has %d columns, expected %d", len(row), len(p.kinds))
+	}
+
+	v := reflect.New(p.typ)
+	fields := v.Elem()
+	for i, s := range row {
+		if s == "" {
+			continue
+		}
+
+		switch p.kinds[i] {
+		case parquetDouble:
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number in column %d: %v", i+1, err)
+			}
+			fields.Field(i).SetFloat(f)
+		case parquetTimestamp:
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid time in column %d: %v", i+1, err)
+			}
+			fields.Field(i).Set(reflect.ValueOf(t))
+		case parquetLabels:
+			var labels map[string]string
+			if err := json.Unmarshal([]byte(s), &labels); err != nil {
+				return nil, fmt.Errorf("invalid labels in column %d: %v", i+1, err)
+			}
+			fields.Field(i).Set(reflect.ValueOf(labels))
+		default:
+			fields.Field(i).SetString(s)
+		}
+	}
+
+	return v.Interface(), nil
+}
+
+// fileExtension returns the extension of the generated files.
+func (a *App) fileExtension() string {
+	if a.OutputFormat == outputFormatParquet {
+		return ".parquet"
+	}
+	return ".csv.gz"
+}
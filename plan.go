@@ -0,0 +1,229 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// FileSummary describes the content of a generated bill file.
+type FileSummary struct {
+	Name  string             `json:"name"`
+	Size  int64              `json:"size"`
+	Rows  int                `json:"rows"`
+	Costs map[string]float64 `json:"costs"` // UsageType -> total cost
+}
+
+// upload publishes the generated files, or only prints what would be uploaded when DryRun is enabled.
+func (a *App) upload() error {
+	if a.DryRun {
+		return a.printUploadPlan(os.Stdout)
+	}
+	return a.uploadToSinks()
+}
+
+// printUploadPlan writes, for every month, the files that would be uploaded with their row count and
+// total cost per cost type, and for every sink whether the month would be published or skipped.
+func (a *App) printUploadPlan(w io.Writer) error {
+	state, err := loadUploadState(a.FilePath)
+	if err != nil {
+		return err
+	}
+
+	months := make([]string, 0, len(a.filesToUpload))
+	for month := range a.filesToUpload {
+		months = append(months, month)
+	}
+	sort.Strings(months)
+
+	sinks := a.newSinks()
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, month := range months {
+		files := a.filesToUpload[month]
+		fmt.Fprintf(tw, "Month %s (%d files)\n", month, len(files))
+
+		for _, sink := range sinks {
+			sinkFiles := a.sinkFiles(sink, month)
+			fmt.Fprintf(tw, "  %s (%d files) %s\n", sink.name(), len(sinkFiles), a.planStatus(sink, state, month, sinkFiles))
+		}
+
+		totalRows := 0
+		totalCosts := make(map[string]float64)
+		for _, fileName := range sortedFileNames(files) {
+			summary, err := summarizeFile(fileName)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(tw, "  %s\t%d rows\t%d bytes\n", summary.Name, summary.Rows, summary.Size)
+			totalRows += summary.Rows
+			for usageType, cost := range summary.Costs {
+				totalCosts[usageType] += cost
+			}
+		}
+
+		fmt.Fprintf(tw, "  Total\t%d rows\n", totalRows)
+		for _, usageType := range sortedKeys(totalCosts) {
+			fmt.Fprintf(tw, "  %s\t%s\n", usageType, strconv.FormatFloat(totalCosts[usageType], 'f', 5, 64))
+		}
+	}
+
+	return tw.Flush()
+}
+
+// planStatus returns whether uploadToSink would publish the files of month to a sink, or why it would skip them.
+func (a *App) planStatus(sink Sink, state *UploadState, month string, files map[string]struct{}) string {
+	if len(files) == 0 {
+		return "would be skipped: no files to upload"
+	}
+	if !a.isMonthComplete(month, files) {
+		return "would be skipped: not all days have a file to upload"
+	}
+	if a.isUnreconciled(month) {
+		return "would be skipped: a day failed the reconciliation with Kubecost"
+	}
+	if checksums, err := getFileChecksums(files); err == nil && state.isPublished(sink.name(), month, sink.target(month), checksums) {
+		return "would be skipped: files did not change since they were last published"
+	}
+	return "would be uploaded"
+}
+
+// summarizeFile reads a generated bill file and returns its row count and total cost per UsageType.
+func summarizeFile(fileName string) (FileSummary, error) {
+	summary := FileSummary{Name: filepath.Base(fileName), Costs: make(map[string]float64)}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return summary, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return summary, err
+	}
+	summary.Size = info.Size()
+
+	if strings.HasSuffix(fileName, ".parquet") {
+		return summarizeParquetFile(file, summary)
+	}
+
+	gzReader, err := gzip.NewReader(file)
+	if err != nil {
+		return summary, fmt.Errorf("invalid gzip format in %s: %v", fileName, err)
+	}
+	defer gzReader.Close()
+
+	csvReader := csv.NewReader(gzReader)
+	headers, err := csvReader.Read()
+	if err != nil {
+		return summary, fmt.Errorf("failed to read headers of %s: %v", fileName, err)
+	}
+
+	costIndex, usageTypeIndex := -1, -1
+	for i, header := range headers {
+		switch header {
+		case "Cost":
+			costIndex = i
+		case "UsageType":
+			usageTypeIndex = i
+		}
+	}
+
+	for {
+		record, err := csvReader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return summary, fmt.Errorf("failed to read %s: %v", fileName, err)
+		}
+
+		summary.Rows++
+		if costIndex < 0 || usageTypeIndex < 0 {
+			continue
+		}
+
+		cost, err := strconv.ParseFloat(record[costIndex], 64)
+		if err != nil {
+			return summary, fmt.Errorf("invalid cost %q in %s: %v", record[costIndex], fileName, err)
+		}
+		summary.Costs[record[usageTypeIndex]] += cost
+	}
+
+	return summary, nil
+}
+
+// summarizeParquetFile returns the row count and total cost per UsageType of a Parquet file.
+func summarizeParquetFile(file *os.File, summary FileSummary) (FileSummary, error) {
+	parquetFile, err := parquet.OpenFile(file, summary.Size)
+	if err != nil {
+		return summary, fmt.Errorf("invalid Parquet format in %s: %v", summary.Name, err)
+	}
+	summary.Rows = int(parquetFile.NumRows())
+
+	costColumn, hasCost := parquetFile.Schema().Lookup("Cost")
+	usageTypeColumn, hasUsageType := parquetFile.Schema().Lookup("UsageType")
+	if !hasCost || !hasUsageType {
+		return summary, nil
+	}
+
+	rows := make([]parquet.Row, 100)
+	for _, rowGroup := range parquetFile.RowGroups() {
+		reader := rowGroup.Rows()
+		for {
+			n, err := reader.ReadRows(rows)
+			for _, row := range rows[:n] {
+				var cost float64
+				var usageType string
+				for _, value := range row {
+					switch value.Column() {
+					case costColumn.ColumnIndex:
+						cost = value.Double()
+					case usageTypeColumn.ColumnIndex:
+						usageType = value.String()
+					}
+				}
+				summary.Costs[usageType] += cost
+			}
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				reader.Close()
+				return summary, fmt.Errorf("failed to read %s: %v", summary.Name, err)
+			}
+		}
+		reader.Close()
+	}
+
+	return summary, nil
+}
+
+func sortedFileNames(files map[string]struct{}) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
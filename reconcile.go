@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reconcileMinDelta is the precision of the exported costs, smaller differences are never reported.
+const reconcileMinDelta = 0.00001
+
+// costTotals are the total costs of a day per cost type, before the multipliers and currency conversion.
+type costTotals map[string]float64
+
+// add adds the costs of an allocation exported as rows, the external costs being left out when they
+// are exported as cloud costs instead.
+func (t costTotals) add(a *App, v KubecostAllocation) {
+	for i, cost := range allocationCosts(v) {
+		costType := allocationCostTypes[i]
+		if costType == "externalCost" && a.ExportCloudCosts {
+			continue
+		}
+		t[costType] += cost
+	}
+}
+
+// reconcile compares the costs exported for the day starting at d with the totals of the same window
+// aggregated by cluster, and fails when a cost type differs by more than ReconcileTolerance of the
+// Kubecost total, which reveals allocations dropped or duplicated while paging.
+func (a *App) reconcile(endpoint KubecostEndpoint, source allocationSource, d time.Time, exported costTotals) error {
+	reqURL, err := source.clusterTotalsURL(endpoint, d)
+	if err != nil {
+		return fmt.Errorf("failed to build cluster totals URL: %w", err)
+	}
+
+	j, err := a.getAllocationPage(endpoint, source, reqURL)
+	if err != nil {
+		return fmt.Errorf("failed to get cluster totals: %v", err)
+	}
+
+	expected := costTotals{}
+	for _, allocation := range j.Data {
+		for _, record := range allocation {
+			expected.add(a, record)
+		}
+	}
+
+	var mismatches []string
+	for _, costType := range allocationCostTypes {
+		delta := math.Abs(exported[costType] - expected[costType])
+		if delta > reconcileMinDelta && delta > a.ReconcileTolerance*math.Abs(expected[costType]) {
+			mismatches = append(mismatches, fmt.Sprintf("%s %s instead of %s",
+				costType, strconv.FormatFloat(exported[costType], 'f', 5, 64), strconv.FormatFloat(expected[costType], 'f', 5, 64)))
+		}
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("exported costs do not match the cluster totals: %s", strings.Join(mismatches, ", "))
+	}
+
+	return nil
+}
+
+// markUnreconciled records that a day of month failed the reconciliation, so the month is not uploaded.
+func (a *App) markUnreconciled(month string) {
+	a.filesMutex.Lock()
+	defer a.filesMutex.Unlock()
+
+	if a.unreconciledMonths == nil {
+		a.unreconciledMonths = make(map[string]struct{})
+	}
+	a.unreconciledMonths[month] = struct{}{}
+}
+
+// isUnreconciled reports whether a day of month failed the reconciliation in the current cycle.
+func (a *App) isUnreconciled(month string) bool {
+	a.filesMutex.Lock()
+	defer a.filesMutex.Unlock()
+
+	_, ok := a.unreconciledMonths[month]
+	return ok
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// doWithRetry sends the request returned by newRequest, retrying network errors, 429 and 5xx
+// responses with exponential backoff and jitter, up to RetryMaxAttempts attempts. A new request
+// is built for every attempt so its body can be sent again. The last response or error is returned
+// once the attempts are exhausted, so callers keep handling the status code as before.
+func (a *App) doWithRetry(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	maxAttempts := max(a.RetryMaxAttempts, 1)
+
+	for attempt := 1; ; attempt++ {
+		request, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		log.Printf("Request (attempt %d/%d): %s %s\n", attempt, maxAttempts, request.Method, request.URL.Redacted())
+		response, err := a.client.Do(request)
+		if err == nil && !isRetryableStatus(response.StatusCode) {
+			return response, nil
+		}
+
+		if attempt >= maxAttempts {
+			if err != nil {
+				return nil, fmt.Errorf("request failed after %d attempts: %w", attempt, err)
+			}
+			log.Printf("Request failed with status code %d after %d attempts\n", response.StatusCode, attempt)
+			return response, nil
+		}
+
+		delay := a.retryDelay(attempt, response)
+		if err != nil {
+			log.Printf("Request failed (attempt %d/%d): %v, retrying in %s\n", attempt, maxAttempts, err, delay)
+		} else {
+			log.Printf("Request failed with status code %d (attempt %d/%d), retrying in %s\n", response.StatusCode, attempt, maxAttempts, delay)
+			_, _ = io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+		}
+
+		if err := a.sleep(delay); err != nil {
+			return nil, fmt.Errorf("request cancelled after %d attempts: %w", attempt, err)
+		}
+	}
+}
+
+// sleep waits for delay, and returns early with the context error when a shutdown is requested, so a
+// backoff never delays the shutdown beyond the date being processed.
+func (a *App) sleep(delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-a.ctx.Done():
+		return a.ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// retryDelay returns the time to wait before the given attempt is retried. The Retry-After header
+// of the response is honoured when present, otherwise the delay doubles with every attempt starting
+// at RetryBaseDelay. Both are capped at RetryMaxDelay and the backoff gets up to 50% of jitter.
+func (a *App) retryDelay(attempt int, response *http.Response) time.Duration {
+	if response != nil {
+		if retryAfter, ok := parseRetryAfter(response.Header.Get("Retry-After")); ok {
+			return min(retryAfter, a.RetryMaxDelay)
+		}
+	}
+
+	delay := a.RetryBaseDelay << (attempt - 1)
+	if delay <= 0 || delay > a.RetryMaxDelay {
+		delay = a.RetryMaxDelay
+	}
+
+	if half := int64(delay / 2); half > 0 {
+		delay = time.Duration(half + rand.Int64N(half+1))
+	}
+
+	return delay
+}
+
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as an HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0), true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Sink uploads the files of a month to an S3-compatible bucket, under <S3_PREFIX>/<month>/. The
+// requests are signed with AWS Signature Version 4, which MinIO and the other S3-compatible stores accept.
+type s3Sink struct {
+	app *App
+}
+
+// validateS3 checks the settings of the s3 sink.
+func (a *App) validateS3() error {
+	if a.S3Bucket == "" {
+		return fmt.Errorf("s3: S3_BUCKET is required by the s3 sink")
+	}
+	if a.S3AccessKeyID == "" || a.S3SecretAccessKey == "" && a.S3SecretAccessKeyFile == "" {
+		return fmt.Errorf("s3: S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY or S3_SECRET_ACCESS_KEY_FILE are required by the s3 sink")
+	}
+	if _, err := a.s3Endpoint(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// s3Endpoint returns S3_ENDPOINT, or the AWS endpoint of S3_REGION when it is not set.
+func (a *App) s3Endpoint() (*url.URL, error) {
+	endpoint := a.S3Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", a.S3Region)
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("s3: endpoint %s is wrong", endpoint)
+	}
+	return u, nil
+}
+
+func (s *s3Sink) name() string {
+	return sinkS3
+}
+
+func (s *s3Sink) accepts(fileName string) bool {
+	return true
+}
+
+func (s *s3Sink) publish(month string, files []string) (string, error) {
+	prefix := path.Join(s.app.S3Prefix, month)
+	for _, fileName := range files {
+		if err := s.putObject(path.Join(prefix, filepath.Base(fileName)), fileName); err != nil {
+			return "", err
+		}
+	}
+
+	return s.target(month).Location, nil
+}
+
+// target returns the bucket and prefix of the month the objects are uploaded to.
+func (s *s3Sink) target(month string) UploadTarget {
+	return UploadTarget{Location: fmt.Sprintf("s3://%s/%s", s.app.S3Bucket, path.Join(s.app.S3Prefix, month))}
+}
+
+// remove deletes the objects of the files under the prefix of the month.
+func (s *s3Sink) remove(month string, files []string) error {
+	prefix := path.Join(s.app.S3Prefix, month)
+	for _, fileName := range files {
+		if err := s.deleteObject(path.Join(prefix, fileName)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// objectURL returns the URL of an object, with the bucket in the path or in the host name.
+func (s *s3Sink) objectURL(key string) (*url.URL, error) {
+	u, err := s.app.s3Endpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	if s.app.S3PathStyle {
+		u.Path = path.Join("/", u.Path, s.app.S3Bucket, key)
+	} else {
+		u.Host = s.app.S3Bucket + "." + u.Host
+		u.Path = path.Join("/", u.Path, key)
+	}
+	return u, nil
+}
+
+func (s *s3Sink) putObject(key, fileName string) error {
+	payloadHash, size, err := sha256File(fileName)
+	if err != nil {
+		return err
+	}
+
+	objectURL, err := s.objectURL(key)
+	if err != nil {
+		return err
+	}
+
+	secretAccessKey, err := readSecret(s.app.S3SecretAccessKey, s.app.S3SecretAccessKeyFile)
+	if err != nil {
+		return err
+	}
+
+	response, err := s.app.doWithRetry(func() (*http.Request, error) {
+		file, err := os.Open(fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		request, err := http.NewRequest(http.MethodPut, objectURL.String(), file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		request.ContentLength = size
+		if s.app.S3SessionToken != "" {
+			request.Header.Set("X-Amz-Security-Token", s.app.S3SessionToken)
+		}
+		signS3Request(request, payloadHash, s.app.S3AccessKeyID, secretAccessKey, s.app.S3Region, time.Now())
+		return request, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s to s3: %v", fileName, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("failed to upload %s to s3: status code %d: %s", fileName, response.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// deleteObject deletes an object. S3 also answers 204 when the object does not exist.
+func (s *s3Sink) deleteObject(key string) error {
+	objectURL, err := s.objectURL(key)
+	if err != nil {
+		return err
+	}
+
+	secretAccessKey, err := readSecret(s.app.S3SecretAccessKey, s.app.S3SecretAccessKeyFile)
+	if err != nil {
+		return err
+	}
+
+	emptyPayloadHash := sha256.Sum256(nil)
+	response, err := s.app.doWithRetry(func() (*http.Request, error) {
+		request, err := http.NewRequest(http.MethodDelete, objectURL.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if s.app.S3SessionToken != "" {
+			request.Header.Set("X-Amz-Security-Token", s.app.S3SessionToken)
+		}
+		signS3Request(request, hex.EncodeToString(emptyPayloadHash[:]), s.app.S3AccessKeyID, secretAccessKey, s.app.S3Region, time.Now())
+		return request, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete %s from s3: %v", key, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("failed to delete %s from s3: status code %d: %s", key, response.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// signS3Request adds the AWS Signature Version 4 Authorization header to a request, signing the host
+// and every header of the request.
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func signS3Request(request *http.Request, payloadHash, accessKeyID, secretAccessKey, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := request.Host
+	if host == "" {
+		host = request.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		s3EscapePath(request.URL.Path),
+		request.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s", accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3EscapePath URI-encodes every byte of the path except the unreserved characters and the slashes.
+func s3EscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// sha256File returns the hex-encoded SHA-256 and the size of a file.
+func sha256File(fileName string) (string, int64, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to hash file %s: %v", fileName, err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sinkFlexera   = "flexera"
+	sinkS3        = "s3"
+	sinkDirectory = "directory"
+)
+
+type (
+	// Sink is a destination of the generated files. Every sink receives the files of the months that
+	// are complete and changed since they were last published to it.
+	Sink interface {
+		// name returns the name of the sink in SINKS, also used as its key in the upload state.
+		name() string
+		// accepts reports whether the sink publishes the given file.
+		accepts(fileName string) bool
+		// publish publishes the files of a month and returns where they were published.
+		publish(month string, files []string) (string, error)
+		// remove removes files previously published for a month, given by their base names.
+		remove(month string, files []string) error
+		// target returns the destination of the files, recorded in the upload state with the published months.
+		target(month string) UploadTarget
+	}
+
+	// flexeraSink uploads the files of a month to a Flexera bill upload. The access token is generated
+	// once per upload cycle.
+	flexeraSink struct {
+		app         *App
+		authHeaders map[string]string
+		tokenErr    error
+	}
+
+	// directorySink copies the files of a month to the month subdirectory of dir.
+	directorySink struct {
+		dir string
+	}
+)
+
+// resolveSinks validates SINKS and the settings of the selected sinks.
+func (a *App) resolveSinks() error {
+	names := make(map[string]struct{}, len(a.Sinks))
+	for _, sink := range a.Sinks {
+		if _, ok := names[sink]; ok {
+			return fmt.Errorf("sinks: %s is used more than once", sink)
+		}
+		names[sink] = struct{}{}
+
+		switch sink {
+		case sinkFlexera:
+		case sinkDirectory:
+			if a.SinkDirectory == "" {
+				return fmt.Errorf("sinks: SINK_DIRECTORY is required by the directory sink")
+			}
+		case sinkS3:
+			if err := a.validateS3(); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("sinks: %s is wrong", sink)
+		}
+	}
+
+	// The manifests are written by the Flexera commits, the other sinks would never receive one
+	if _, ok := names[sinkFlexera]; a.UploadManifest && !ok {
+		return fmt.Errorf("upload manifest: the flexera sink is required to write the manifests")
+	}
+
+	return nil
+}
+
+// newSinks returns the sinks of an upload cycle, in the SINKS order except for Flexera which comes first,
+// so the manifests it writes are published to the other sinks in the same cycle.
+func (a *App) newSinks() []Sink {
+	sinks := make([]Sink, 0, len(a.Sinks))
+	for _, sink := range a.Sinks {
+		switch sink {
+		case sinkFlexera:
+			sinks = append([]Sink{&flexeraSink{app: a}}, sinks...)
+		case sinkDirectory:
+			sinks = append(sinks, directorySink{dir: a.SinkDirectory})
+		case sinkS3:
+			sinks = append(sinks, &s3Sink{app: a})
+		}
+	}
+	return sinks
+}
+
+// uploadToSinks publishes the complete months to every sink. A sink failing does not prevent the
+// other sinks from receiving the files.
+func (a *App) uploadToSinks() error {
+	start := time.Now()
+	defer func() {
+		cycleDuration.WithLabelValues("upload").Observe(time.Since(start).Seconds())
+	}()
+
+	state, err := loadUploadState(a.FilePath)
+	if err != nil {
+		return err
+	}
+	for month, committed := range state.Months {
+		lastCommitTimestamp.WithLabelValues(month).Set(float64(committed.CommittedAt.Unix()))
+	}
+
+	atLeastOneError := false
+	for _, sink := range a.newSinks() {
+		if !a.uploadToSink(sink, state) {
+			atLeastOneError = true
+		}
+	}
+
+	//If at least one error in bill processing report it, so the caller can exit with code 1
+	if atLeastOneError {
+		return fmt.Errorf("error during bill upload. Internal server error")
+	}
+
+	return nil
+}
+
+// uploadToSink publishes the complete and changed months to a sink, and reports whether all of them
+// were published.
+func (a *App) uploadToSink(sink Sink, state *UploadState) bool {
+	months := make([]string, 0, len(a.filesToUpload))
+	for month := range a.filesToUpload {
+		months = append(months, month)
+	}
+	sort.Strings(months)
+
+	ok := true
+	for _, month := range months {
+		files := a.sinkFiles(sink, month)
+
+		if len(files) == 0 {
+			log.Println("No files to upload for month", month, "to", sink.name())
+			continue
+		}
+
+		if !a.isMonthComplete(month, files) {
+			log.Println("Skipping month", month, "because not all days have a file to upload")
+			continue
+		}
+
+		if a.isUnreconciled(month) {
+			log.Println("Skipping month", month, "because a day failed the reconciliation with Kubecost")
+			ok = false
+			continue
+		}
+
+		checksums, err := getFileChecksums(files)
+		if err != nil {
+			log.Printf("Error computing checksums for month %s: %v", month, err)
+			ok = false
+			continue
+		}
+
+		target := sink.target(month)
+		if state.isRetargeted(sink.name(), month, target) {
+			log.Printf("Publishing month %s again because the destination of %s changed since it was published", month, sink.name())
+		}
+		if state.isPublished(sink.name(), month, target, checksums) {
+			log.Printf("Skipping month %s because its files did not change since they were published to %s", month, sink.name())
+			lastUpToDateTimestamp.WithLabelValues(sink.name(), month).SetToCurrentTime()
+			continue
+		}
+
+		location, err := sink.publish(month, sortedFileNames(files))
+		// The files that are no longer part of the month, such as split files of a day exported with fewer
+		// rows, are removed before the new files are recorded, so a failed removal is retried next cycle
+		if err == nil {
+			err = sink.remove(month, state.staleFiles(sink.name(), month, target, checksums))
+		}
+		if err == nil {
+			state.recordPublish(sink.name(), month, location, target, checksums)
+			err = state.save(a.FilePath)
+		}
+		if err != nil {
+			log.Println(err)
+			ok = false
+			continue
+		}
+		lastUpToDateTimestamp.WithLabelValues(sink.name(), month).SetToCurrentTime()
+		log.Printf("Published %d files of month %s to %s %s", len(files), month, sink.name(), location)
+	}
+
+	return ok
+}
+
+// sinkFiles returns the files of month published by a sink, with the manifest of the month when
+// UploadManifest is set.
+func (a *App) sinkFiles(sink Sink, month string) map[string]struct{} {
+	files := make(map[string]struct{}, len(a.filesToUpload[month]))
+	for fileName := range a.filesToUpload[month] {
+		if sink.accepts(fileName) {
+			files[fileName] = struct{}{}
+		}
+	}
+
+	// The manifest alone is not published, there must be files of the month
+	if len(files) > 0 && a.UploadManifest && sink.name() != sinkFlexera {
+		manifestPath := filepath.Join(a.FilePath, manifestFileName(month))
+		if _, err := os.Stat(manifestPath); err == nil && sink.accepts(manifestPath) {
+			files[manifestPath] = struct{}{}
+		}
+	}
+
+	return files
+}
+
+func (s *flexeraSink) name() string {
+	return sinkFlexera
+}
+
+// accepts reports whether the file is a CSV file, Flexera does not accept the Parquet files and the manifests.
+func (s *flexeraSink) accepts(fileName string) bool {
+	return strings.HasSuffix(fileName, ".csv.gz") || strings.HasSuffix(fileName, ".csv")
+}
+
+func (s *flexeraSink) publish(month string, files []string) (string, error) {
+	a := s.app
+
+	if s.authHeaders == nil && s.tokenErr == nil {
+		accessToken, err := a.generateAccessToken()
+		if err != nil {
+			s.tokenErr = fmt.Errorf("error generating access token: %v", err)
+		} else {
+			s.authHeaders = map[string]string{"Authorization": "Bearer " + accessToken}
+		}
+	}
+	if s.tokenErr != nil {
+		return "", s.tokenErr
+	}
+
+	manifest, err := a.newManifest(month, files)
+	if err != nil {
+		return "", err
+	}
+
+	billUploadID, err := a.StartBillUploadProcess(month, s.authHeaders)
+	if err != nil {
+		return "", err
+	}
+
+	for _, fileName := range files {
+		if err := a.UploadFile(billUploadID, fileName, s.authHeaders); err != nil {
+			log.Printf("Error uploading file: %s. %s\n", fileName, err.Error())
+			if abortErr := a.AbortBillUploadProcess(billUploadID, s.authHeaders); abortErr != nil {
+				log.Println(abortErr)
+			}
+			return "", err
+		}
+	}
+
+	if err := a.CommitBillUploadProcess(billUploadID, s.authHeaders); err != nil {
+		return "", err
+	}
+	lastCommitTimestamp.WithLabelValues(month).SetToCurrentTime()
+
+	// The bill upload is committed, a manifest that cannot be written must not cause it to be uploaded again
+	manifest.BillUploadID = billUploadID
+	manifest.CommittedAt = time.Now().UTC()
+	if err := manifest.save(a.FilePath); err != nil {
+		log.Printf("Warning: failed to write manifest of month %s: %v", month, err)
+	}
+
+	return billUploadID, nil
+}
+
+// target returns the bill connect of the organization the months are committed to.
+func (s *flexeraSink) target(month string) UploadTarget {
+	return UploadTarget{BillConnectID: s.app.BillConnectID, OrgID: s.app.OrgID, Shard: s.app.Shard}
+}
+
+// remove does nothing, each bill upload replaces all the files of the month in Flexera.
+func (s *flexeraSink) remove(month string, files []string) error {
+	return nil
+}
+
+func (s directorySink) name() string {
+	return sinkDirectory
+}
+
+func (s directorySink) accepts(fileName string) bool {
+	return true
+}
+
+// publish copies the files under a temp name first, so readers of the directory never see a partial file.
+func (s directorySink) publish(month string, files []string) (string, error) {
+	dir := filepath.Join(s.dir, month)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory %s: %v", dir, err)
+	}
+
+	for _, fileName := range files {
+		if err := copyFile(fileName, filepath.Join(dir, filepath.Base(fileName))); err != nil {
+			return "", err
+		}
+	}
+
+	return dir, nil
+}
+
+// target returns the month subdirectory the files are copied to.
+func (s directorySink) target(month string) UploadTarget {
+	return UploadTarget{Location: filepath.Join(s.dir, month)}
+}
+
+func (s directorySink) remove(month string, files []string) error {
+	for _, fileName := range files {
+		filePath := filepath.Join(s.dir, month, fileName)
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %v", filePath, err)
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", src, err)
+	}
+	defer in.Close()
+
+	tempPath := dst + ".tmp"
+	out, err := os.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", tempPath, err)
+	}
+
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to copy %s: %v", src, err)
+	}
+
+	if err := os.Rename(tempPath, dst); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to rename %s: %v", tempPath, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+)
+
+const (
+	sourceKubecost = "kubecost"
+	sourceOpenCost = "opencost"
+
+	resolutionDaily  = "1d"
+	resolutionHourly = "1h"
+)
+
+type (
+	// allocationSource builds the allocation requests of a cost model API and adapts its responses,
+	// so Kubecost and OpenCost feed the same getCSVRowsFromRecord pipeline.
+	allocationSource interface {
+		// allocationURL returns the URL of the given page of allocations of the day starting at d.
+		allocationURL(endpoint KubecostEndpoint, d time.Time, page int) (string, error)
+		// decodeAllocations decodes a response into a Kubecost Allocation API response.
+		decodeAllocations(r io.Reader) (*KubecostAllocationResponse, error)
+		// lastPage reports whether the response is the last page of the day.
+		lastPage(j *KubecostAllocationResponse) bool
+		// clusterTotalsURL returns the URL of the allocations of the day starting at d aggregated by
+		// cluster, in a single page, used to reconcile the exported costs.
+		clusterTotalsURL(endpoint KubecostEndpoint, d time.Time) (string, error)
+	}
+
+	kubecostSource struct {
+		app *App
+	}
+
+	openCostSource struct {
+		app *App
+	}
+
+	OpenCostAllocationResponse struct {
+		Code    int64                            `json:"code"`
+		Status  string                           `json:"status"`
+		Message string                           `json:"message"`
+		Data    []map[string]*KubecostAllocation `json:"data"`
+	}
+)
+
+func (a *App) allocationSource(endpoint KubecostEndpoint) allocationSource {
+	if endpoint.Source == sourceOpenCost {
+		return openCostSource{app: a}
+	}
+	return kubecostSource{app: a}
+}
+
+// https://github.com/kubecost/docs/blob/master/allocation.md#querying
+func (s kubecostSource) allocationURL(endpoint KubecostEndpoint, d time.Time, page int) (string, error) {
+	reqURL, err := endpoint.url(endpoint.Host, endpoint.APIPath, "allocation")
+	if err != nil {
+		return "", err
+	}
+
+	q := s.query(d, s.app.aggregation)
+	q.Add("offset", fmt.Sprintf("%d", page*s.app.PageSize))
+	q.Add("limit", fmt.Sprintf("%d", s.app.PageSize))
+
+	return reqURL + "?" + q.Encode(), nil
+}
+
+// clusterTotalsURL shares and includes the idle costs like allocationURL, so the totals of the clusters
+// are the totals of the exported allocations.
+func (s kubecostSource) clusterTotalsURL(endpoint KubecostEndpoint, d time.Time) (string, error) {
+	reqURL, err := endpoint.url(endpoint.Host, endpoint.APIPath, "allocation")
+	if err != nil {
+		return "", err
+	}
+
+	return reqURL + "?" + s.query(d, "cluster").Encode(), nil
+}
+
+func (s kubecostSource) query(d time.Time, aggregate string) url.Values {
+	q := url.Values{}
+	q.Add("window", formatWindow(d))
+	q.Add("aggregate", aggregate)
+	q.Add("idle", fmt.Sprintf("%t", s.app.Idle))
+	q.Add("includeIdle", fmt.Sprintf("%t", s.app.Idle))
+	q.Add("idleByNode", fmt.Sprintf("%t", s.app.IdleByNode))
+	q.Add("shareIdle", fmt.Sprintf("%t", s.app.ShareIdle))
+	q.Add("shareNamespaces", s.app.ShareNamespaces)
+	q.Add("shareSplit", "weighted")
+	q.Add("shareTenancyCosts", fmt.Sprintf("%t", s.app.ShareTenancyCosts))
+	s.app.addResolution(q)
+
+	return q
+}
+
+func (s kubecostSource) decodeAllocations(r io.Reader) (*KubecostAllocationResponse, error) {
+	j := &KubecostAllocationResponse{}
+	if err := json.NewDecoder(r).Decode(j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// lastPage reports whether every set of the response is shorter than a full page. With an hourly
+// resolution each hour is a set paged on its own, so a single full set means there are more records.
+func (s kubecostSource) lastPage(j *KubecostAllocationResponse) bool {
+	// An empty response means there are no more records, also when the window has no data at all
+	if len(j.Data) == 0 {
+		return true
+	}
+
+	for _, allocation := range j.Data {
+		totalRecords := len(allocation)
+		if s.app.ShareIdle && totalRecords >= s.app.PageSize || !s.app.ShareIdle && totalRecords >= s.app.PageSize+1 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// OpenCost does not page allocations nor support the Kubecost sharing parameters, the whole day is
+// returned in a single response.
+// https://www.opencost.io/docs/integrations/api#allocation-api
+func (s openCostSource) allocationURL(endpoint KubecostEndpoint, d time.Time, page int) (string, error) {
+	return s.url(endpoint, d, s.app.aggregation)
+}
+
+func (s openCostSource) clusterTotalsURL(endpoint KubecostEndpoint, d time.Time) (string, error) {
+	return s.url(endpoint, d, "cluster")
+}
+
+func (s openCostSource) url(endpoint KubecostEndpoint, d time.Time, aggregate string) (string, error) {
+	reqURL, err := endpoint.url(endpoint.Host, endpoint.APIPath, "allocation/compute")
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{}
+	q.Add("window", formatWindow(d))
+	q.Add("aggregate", aggregate)
+	q.Add("includeIdle", fmt.Sprintf("%t", s.app.Idle))
+	s.app.addResolution(q)
+
+	return reqURL + "?" + q.Encode(), nil
+}
+
+// decodeAllocations adapts an OpenCost response. OpenCost encodes NaN values and empty sets as null,
+// and may leave the allocation name and start and end times empty.
+func (s openCostSource) decodeAllocations(r io.Reader) (*KubecostAllocationResponse, error) {
+	var o OpenCostAllocationResponse
+	if err := json.NewDecoder(r).Decode(&o); err != nil {
+		return nil, err
+	}
+
+	j := &KubecostAllocationResponse{Code: o.Code, Message: o.Message}
+	for _, set := range o.Data {
+		allocations := make(map[string]KubecostAllocation, len(set))
+		for name, allocation := range set {
+			if allocation == nil {
+				continue
+			}
+			if allocation.Name == "" {
+				allocation.Name = name
+			}
+			if allocation.Start == "" {
+				allocation.Start = allocation.Window.Start
+			}
+			if allocation.End == "" {
+				allocation.End = allocation.Window.End
+			}
+			allocations[name] = *allocation
+		}
+		if len(allocations) > 0 {
+			j.Data = append(j.Data, allocations)
+		}
+	}
+
+	return j, nil
+}
+
+func (s openCostSource) lastPage(j *KubecostAllocationResponse) bool {
+	return true
+}
+
+// addResolution adds the step of the allocation sets to the query. Daily sets are accumulated over
+// the window, hourly sets are returned one per hour.
+func (a *App) addResolution(q url.Values) {
+	q.Add("step", a.Resolution)
+	q.Add("accumulate", fmt.Sprintf("%t", a.Resolution == resolutionDaily))
+}
+
+func formatWindow(d time.Time) string {
+	return fmt.Sprintf("%s,%s", d.Format("2006-01-02T15:04:05Z"), d.AddDate(0, 0, 1).Format("2006-01-02T15:04:05Z"))
+}
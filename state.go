@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const stateFileName = ".kubecost-exporter-state.json"
+
+type (
+	// UploadState records, per billing month, the files committed by the last successful bill upload,
+	// and per sink the files published by the other sinks.
+	UploadState struct {
+		Months map[string]MonthUploadState            `json:"months"`
+		Sinks  map[string]map[string]MonthUploadState `json:"sinks,omitempty"`
+	}
+
+	MonthUploadState struct {
+		BillUploadID string `json:"billUploadId,omitempty"`
+		UploadTarget
+		CommittedAt time.Time         `json:"committedAt"`
+		Files       map[string]string `json:"files"` // file base name -> MD5
+	}
+
+	// UploadTarget is the destination a month was published to. A month is published again when the
+	// destination of its sink changes, even if its files did not.
+	UploadTarget struct {
+		BillConnectID string `json:"billConnectId,omitempty"`
+		OrgID         string `json:"orgId,omitempty"`
+		Shard         string `json:"shard,omitempty"`
+		Location      string `json:"location,omitempty"`
+	}
+)
+
+// loadUploadState reads the upload state stored in dir. A missing state file is not an error,
+// it returns an empty state so every month is uploaded.
+func loadUploadState(dir string) (*UploadState, error) {
+	state := &UploadState{Months: make(map[string]MonthUploadState)}
+
+	data, err := os.ReadFile(filepath.Join(dir, stateFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, fmt.Errorf("failed to read upload state: %v", err)
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse upload state: %v", err)
+	}
+	if state.Months == nil {
+		state.Months = make(map[string]MonthUploadState)
+	}
+
+	return state, nil
+}
+
+// save writes the state atomically, so an interrupted run never leaves a truncated state file.
+func (s *UploadState) save(dir string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode upload state: %v", err)
+	}
+
+	statePath := filepath.Join(dir, stateFileName)
+	tempPath := statePath + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write upload state: %v", err)
+	}
+
+	if err := os.Rename(tempPath, statePath); err != nil {
+		return fmt.Errorf("failed to replace upload state: %v", err)
+	}
+
+	return nil
+}
+
+func (s *UploadState) recordCommit(month, billUploadID string, target UploadTarget, checksums map[string]string) {
+	s.Months[month] = MonthUploadState{
+		BillUploadID: billUploadID,
+		UploadTarget: target,
+		CommittedAt:  time.Now().UTC(),
+		Files:        checksums,
+	}
+}
+
+// months returns the state of the months published by a sink. The Flexera commits are kept in
+// Months, where they were recorded before there were other sinks.
+func (s *UploadState) months(sink string) map[string]MonthUploadState {
+	if sink == sinkFlexera {
+		return s.Months
+	}
+	return s.Sinks[sink]
+}
+
+// isPublished reports whether the given files are byte-identical to the ones last published by sink for month,
+// to the same target.
+func (s *UploadState) isPublished(sink, month string, target UploadTarget, checksums map[string]string) bool {
+	committed, ok := s.months(sink)[month]
+	if !ok || committed.UploadTarget != target || len(committed.Files) != len(checksums) {
+		return false
+	}
+
+	for name, md5Hash := range checksums {
+		if committed.Files[name] != md5Hash {
+			return false
+		}
+	}
+
+	return true
+}
+
+// staleFiles returns the sorted base names of the files last published by sink for month to target that are not
+// in checksums. The files published to a previous target are left there.
+func (s *UploadState) staleFiles(sink, month string, target UploadTarget, checksums map[string]string) []string {
+	published := s.months(sink)[month]
+	if published.UploadTarget != target {
+		return nil
+	}
+
+	var stale []string
+	for name := range published.Files {
+		if _, ok := checksums[name]; !ok {
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// isRetargeted reports whether sink published month to another target than the given one.
+func (s *UploadState) isRetargeted(sink, month string, target UploadTarget) bool {
+	published, ok := s.months(sink)[month]
+	return ok && published.UploadTarget != target
+}
+
+// recordPublish records the files published by a sink to target. For Flexera, location is the bill upload ID,
+// the location of the other sinks is their target.
+func (s *UploadState) recordPublish(sink, month, location string, target UploadTarget, checksums map[string]string) {
+	if sink == sinkFlexera {
+		s.recordCommit(month, location, target, checksums)
+		return
+	}
+
+	if s.Sinks == nil {
+		s.Sinks = make(map[string]map[string]MonthUploadState)
+	}
+	if s.Sinks[sink] == nil {
+		s.Sinks[sink] = make(map[string]MonthUploadState)
+	}
+	s.Sinks[sink][month] = MonthUploadState{
+		UploadTarget: target,
+		CommittedAt:  time.Now().UTC(),
+		Files:        checksums,
+	}
+}
+
+// getFileChecksums returns the MD5 of every file keyed by its base name.
+func getFileChecksums(files map[string]struct{}) (map[string]string, error) {
+	checksums := make(map[string]string, len(files))
+
+	for fileName := range files {
+		md5Hash, err := getMD5FromFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		checksums[filepath.Base(fileName)] = md5Hash
+	}
+
+	return checksums, nil
+}
+
+func getMD5FromFile(fileName string) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to hash file %s: %v", fileName, err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}